@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/blendlabs/go-logger"
+	web "github.com/blendlabs/go-web"
+)
+
+// logEventsMaxRevertAfter is the longest a log events change can be reverted after.
+const logEventsMaxRevertAfter = 24 * time.Hour
+
+// logEventsKnown are the events `/_admin/log/events` always reports, whether or not they were set explicitly.
+var logEventsKnown = []logger.EventFlag{
+	logger.EventFatalError,
+	logger.EventError,
+	logger.EventWarning,
+	logger.EventInfo,
+	logger.EventDebug,
+	logger.EventSilly,
+	logger.EventWebRequestStart,
+	logger.EventWebRequest,
+	logger.EventWebRequestPostBody,
+	logger.EventWebResponse,
+}
+
+// eventCount is a count of log events for an event flag.
+type eventCount struct {
+	Event string `json:"event" xml:"event,attr" yaml:"event"`
+	Count int64  `json:"count" xml:",chardata" yaml:"count"`
+}
+
+// logQueueReport is the health of the logger event queue.
+type logQueueReport struct {
+	XMLName        xml.Name     `json:"-" xml:"log_queue" yaml:"-"`
+	Policy         string       `json:"policy" xml:"policy" yaml:"policy"`
+	Length         int          `json:"length" xml:"length" yaml:"length"`
+	Capacity       int          `json:"capacity" xml:"capacity" yaml:"capacity"`
+	HighWater      int          `json:"high_water" xml:"high_water" yaml:"high_water"`
+	Workers        int          `json:"workers" xml:"workers" yaml:"workers"`
+	Enqueued       int64        `json:"enqueued" xml:"enqueued" yaml:"enqueued"`
+	Processed      int64        `json:"processed" xml:"processed" yaml:"processed"`
+	Synchronous    int64        `json:"synchronous" xml:"synchronous" yaml:"synchronous"`
+	Dropped        int64        `json:"dropped" xml:"dropped" yaml:"dropped"`
+	Sampled        int64        `json:"sampled" xml:"sampled" yaml:"sampled"`
+	DroppedByEvent []eventCount `json:"dropped_by_event,omitempty" xml:"dropped_event,omitempty" yaml:"dropped_by_event,omitempty"`
+	AverageLatency string       `json:"average_latency" xml:"average_latency" yaml:"average_latency"`
+	MaxLatency     string       `json:"max_latency" xml:"max_latency" yaml:"max_latency"`
+}
+
+// String returns the report as `Key: value` lines.
+func (lqr logQueueReport) String() string {
+	buffer := bytes.NewBuffer(nil)
+	fmt.Fprintf(buffer, "Policy: %s\n", lqr.Policy)
+	fmt.Fprintf(buffer, "Length: %d/%d (high water %d)\n", lqr.Length, lqr.Capacity, lqr.HighWater)
+	fmt.Fprintf(buffer, "Workers: %d\n", lqr.Workers)
+	fmt.Fprintf(buffer, "Enqueued: %d\n", lqr.Enqueued)
+	fmt.Fprintf(buffer, "Processed: %d\n", lqr.Processed)
+	fmt.Fprintf(buffer, "Synchronous: %d\n", lqr.Synchronous)
+	fmt.Fprintf(buffer, "Dropped: %d\n", lqr.Dropped)
+	for _, dropped := range lqr.DroppedByEvent {
+		fmt.Fprintf(buffer, "  %s: %d\n", dropped.Event, dropped.Count)
+	}
+	fmt.Fprintf(buffer, "Sampled: %d\n", lqr.Sampled)
+	fmt.Fprintf(buffer, "Latency: %s (max %s)\n", lqr.AverageLatency, lqr.MaxLatency)
+	return buffer.String()
+}
+
+// newLogQueueReport returns the report for an agent's event queue.
+func newLogQueueReport(agent *logger.Agent) logQueueReport {
+	health := agent.QueueHealth()
+	report := logQueueReport{
+		Policy:         string(health.Policy),
+		Length:         health.Length,
+		Capacity:       health.Capacity,
+		HighWater:      health.HighWater,
+		Workers:        health.Workers,
+		Enqueued:       health.Enqueued,
+		Processed:      health.Processed,
+		Synchronous:    health.Synchronous,
+		Dropped:        health.Dropped,
+		Sampled:        health.Sampled,
+		AverageLatency: health.AverageLatency.String(),
+		MaxLatency:     health.MaxLatency.String(),
+	}
+	for _, dropped := range health.DroppedByEvent {
+		report.DroppedByEvent = append(report.DroppedByEvent, eventCount{Event: string(dropped.Event), Count: dropped.Count})
+	}
+	return report
+}
+
+// logEventsRequest is the body of `PUT /_admin/log/events`.
+type logEventsRequest struct {
+	Events      *string          `json:"events"`
+	Enable      []string         `json:"enable"`
+	Disable     []string         `json:"disable"`
+	RevertAfter callbackDuration `json:"revert_after"`
+}
+
+// logEventsReport is the enabled log events, and when a temporary change reverts.
+type logEventsReport struct {
+	XMLName   xml.Name   `json:"-" xml:"log_events" yaml:"-"`
+	Events    string     `json:"events" xml:"events" yaml:"events"`
+	Enabled   []string   `json:"enabled" xml:"enabled" yaml:"enabled"`
+	Disabled  []string   `json:"disabled" xml:"disabled" yaml:"disabled"`
+	RevertUTC *time.Time `json:"revert_utc,omitempty" xml:"revert_utc,omitempty" yaml:"revert_utc,omitempty"`
+	RevertTo  string     `json:"revert_to,omitempty" xml:"revert_to,omitempty" yaml:"revert_to,omitempty"`
+}
+
+// String returns the report as `Key: value` lines.
+func (ler logEventsReport) String() string {
+	buffer := bytes.NewBuffer(nil)
+	fmt.Fprintf(buffer, "Events: %s\n", ler.Events)
+	fmt.Fprintf(buffer, "Enabled: %s\n", strings.Join(ler.Enabled, ", "))
+	fmt.Fprintf(buffer, "Disabled: %s\n", strings.Join(ler.Disabled, ", "))
+	if ler.RevertUTC != nil {
+		fmt.Fprintf(buffer, "Reverts: %s to %s\n", ler.RevertUTC.Format(time.RFC3339), ler.RevertTo)
+	}
+	return buffer.String()
+}
+
+// logEvents changes the agent's enabled events at runtime, optionally reverting the change after a while.
+type logEvents struct {
+	agent *logger.Agent
+
+	lock      sync.Mutex
+	revert    *time.Timer
+	revertTo  *logger.EventFlagSet
+	revertUTC time.Time
+}
+
+// get reports the enabled events.
+func (le *logEvents) get(r *web.Ctx) web.Result {
+	le.lock.Lock()
+	report := le.reportLocked()
+	le.lock.Unlock()
+	return r.Negotiated().Result(report)
+}
+
+// put changes the enabled events from a json `logEventsRequest`: `events` replaces them (as `LOG_EVENTS` would),
+// then `enable` and `disable` are applied. With `revert_after`, the events before the first of a run of temporary
+// changes are restored after it passes; without it, the change is kept and any pending revert is cancelled.
+func (le *logEvents) put(r *web.Ctx) web.Result {
+	var request logEventsRequest
+	body, err := r.PostBody()
+	if err != nil {
+		return r.Negotiated().InternalError(err)
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return r.Negotiated().BadRequest(fmt.Sprintf("invalid log events: %v", err))
+	}
+	if request.Events == nil && len(request.Enable) == 0 && len(request.Disable) == 0 {
+		return r.Negotiated().BadRequest("invalid log events; expected at least one of `events`, `enable` or `disable`")
+	}
+	if request.RevertAfter < 0 || time.Duration(request.RevertAfter) > logEventsMaxRevertAfter {
+		return r.Negotiated().BadRequest(fmt.Sprintf("invalid revert_after; expected between 0 and %v", logEventsMaxRevertAfter))
+	}
+	for _, event := range append(append([]string{}, request.Enable...), request.Disable...) {
+		if err := validateLogEvent(event); err != nil {
+			return r.Negotiated().BadRequest(err.Error())
+		}
+	}
+
+	le.lock.Lock()
+	previous := le.agent.EventsSnapshot()
+	events := previous.Copy()
+	if request.Events != nil {
+		events = logger.NewEventFlagSetFromCSV(*request.Events)
+	}
+	for _, event := range request.Enable {
+		events.Enable(logger.EventFlag(strings.ToLower(event)))
+	}
+	for _, event := range request.Disable {
+		events.Disable(logger.EventFlag(strings.ToLower(event)))
+	}
+	le.agent.SetVerbosity(events)
+
+	if request.RevertAfter > 0 {
+		if le.revert == nil {
+			le.revertTo = previous
+		} else {
+			le.revert.Stop()
+		}
+		revertTo := le.revertTo
+		le.revertUTC = time.Now().UTC().Add(time.Duration(request.RevertAfter))
+		le.revert = time.AfterFunc(time.Duration(request.RevertAfter), func() { le.revertEvents(revertTo) })
+	} else if le.revert != nil {
+		le.revert.Stop()
+		le.revert = nil
+		le.revertTo = nil
+	}
+	report := le.reportLocked()
+	le.lock.Unlock()
+
+	if report.RevertUTC != nil {
+		le.agent.Sync().Infof("log events changed to %s until %s", report.Events, report.RevertUTC.Format(time.RFC3339))
+	} else {
+		le.agent.Sync().Infof("log events changed to %s", report.Events)
+	}
+	return r.Negotiated().Result(report)
+}
+
+// revertEvents restores the events from before a temporary change, unless the change was since made permanent or extended.
+func (le *logEvents) revertEvents(revertTo *logger.EventFlagSet) {
+	le.lock.Lock()
+	if le.revertTo != revertTo || time.Now().UTC().Before(le.revertUTC) {
+		le.lock.Unlock()
+		return
+	}
+	le.agent.SetVerbosity(revertTo)
+	le.revert = nil
+	le.revertTo = nil
+	le.lock.Unlock()
+	le.agent.Sync().Infof("log events reverted to %s", revertTo.String())
+}
+
+func (le *logEvents) reportLocked() logEventsReport {
+	events := le.agent.EventsSnapshot()
+	report := logEventsReport{
+		Events:   events.String(),
+		Enabled:  []string{},
+		Disabled: []string{},
+	}
+	seen := map[logger.EventFlag]bool{}
+	flags := append([]logger.EventFlag{}, logEventsKnown...)
+	for flag := range events.Flags() {
+		flags = append(flags, flag)
+	}
+	for _, flag := range flags {
+		if seen[flag] || flag == logger.EventAll || flag == logger.EventNone {
+			continue
+		}
+		seen[flag] = true
+		if events.IsEnabled(flag) {
+			report.Enabled = append(report.Enabled, string(flag))
+		} else {
+			report.Disabled = append(report.Disabled, string(flag))
+		}
+	}
+	sort.Strings(report.Enabled)
+	sort.Strings(report.Disabled)
+	if le.revert != nil {
+		revertUTC := le.revertUTC
+		report.RevertUTC = &revertUTC
+		report.RevertTo = le.revertTo.String()
+	}
+	return report
+}
+
+// validateLogEvent returns an error if an event can't be enabled or disabled by name.
+func validateLogEvent(event string) error {
+	switch {
+	case len(event) == 0 || strings.ContainsAny(event, ", \t\n"):
+		return fmt.Errorf("invalid event %q", event)
+	case logger.EventFlag(strings.ToLower(event)) == logger.EventAll || logger.EventFlag(strings.ToLower(event)) == logger.EventNone:
+		return fmt.Errorf("invalid event %q; use `events` to enable all or none", event)
+	}
+	return nil
+}
+
+// registerAdmin adds the `/_admin` routes to an app behind the admin middleware; they are not added without it.
+func registerAdmin(app *web.App, admin web.Middleware, agent *logger.Agent, aggregator *web.ErrorAggregator) {
+	if admin == nil {
+		return
+	}
+	app.GET("/_admin/log/queue", func(r *web.Ctx) web.Result {
+		return r.Negotiated().Result(newLogQueueReport(agent))
+	}, admin)
+	events := &logEvents{agent: agent}
+	app.GET("/_admin/log/events", events.get, admin)
+	app.PUT("/_admin/log/events", events.put, admin)
+	registerErrors(app, admin, aggregator)
+}
+
+// errorSampleReport is the request an error group was last seen for.
+type errorSampleReport struct {
+	Method     string  `json:"method" xml:"method" yaml:"method"`
+	URL        string  `json:"url" xml:"url" yaml:"url"`
+	Route      string  `json:"route,omitempty" xml:"route,omitempty" yaml:"route,omitempty"`
+	RemoteAddr string  `json:"remote_addr,omitempty" xml:"remote_addr,omitempty" yaml:"remote_addr,omitempty"`
+	RequestID  string  `json:"request_id,omitempty" xml:"request_id,omitempty" yaml:"request_id,omitempty"`
+	Headers    headers `json:"headers,omitempty" xml:"headers,omitempty" yaml:"headers,omitempty"`
+}
+
+// errorGroupReport is an error group; the stack is only reported by `/_admin/errors/{key}`.
+type errorGroupReport struct {
+	XMLName      xml.Name           `json:"-" xml:"error_group" yaml:"-"`
+	Key          string             `json:"key" xml:"key,attr" yaml:"key"`
+	Event        string             `json:"event" xml:"event" yaml:"event"`
+	Message      string             `json:"message" xml:"message" yaml:"message"`
+	Frame        string             `json:"frame,omitempty" xml:"frame,omitempty" yaml:"frame,omitempty"`
+	Count        int64              `json:"count" xml:"count" yaml:"count"`
+	FirstSeenUTC time.Time          `json:"first_seen_utc" xml:"first_seen_utc" yaml:"first_seen_utc"`
+	LastSeenUTC  time.Time          `json:"last_seen_utc" xml:"last_seen_utc" yaml:"last_seen_utc"`
+	Sample       *errorSampleReport `json:"sample,omitempty" xml:"sample,omitempty" yaml:"sample,omitempty"`
+	Stack        []string           `json:"stack,omitempty" xml:"stack_frame,omitempty" yaml:"stack,omitempty"`
+}
+
+// String returns the group as `Key: value` lines with an indented line per stack frame.
+func (egr errorGroupReport) String() string {
+	buffer := bytes.NewBuffer(nil)
+	egr.writeTo(buffer, "")
+	return buffer.String()
+}
+
+func (egr errorGroupReport) writeTo(buffer *bytes.Buffer, indent string) {
+	fmt.Fprintf(buffer, "%sKey: %s\n", indent, egr.Key)
+	fmt.Fprintf(buffer, "%sEvent: %s\n", indent, egr.Event)
+	fmt.Fprintf(buffer, "%sMessage: %s\n", indent, egr.Message)
+	if len(egr.Frame) > 0 {
+		fmt.Fprintf(buffer, "%sFrame: %s\n", indent, egr.Frame)
+	}
+	fmt.Fprintf(buffer, "%sCount: %d\n", indent, egr.Count)
+	fmt.Fprintf(buffer, "%sFirst Seen: %s\n", indent, egr.FirstSeenUTC.Format(time.RFC3339))
+	fmt.Fprintf(buffer, "%sLast Seen: %s\n", indent, egr.LastSeenUTC.Format(time.RFC3339))
+	if egr.Sample != nil {
+		fmt.Fprintf(buffer, "%sSample: %s %s", indent, egr.Sample.Method, egr.Sample.URL)
+		if len(egr.Sample.RequestID) > 0 {
+			fmt.Fprintf(buffer, " (request id %s)", egr.Sample.RequestID)
+		}
+		buffer.WriteRune('\n')
+	}
+	for _, frame := range egr.Stack {
+		fmt.Fprintf(buffer, "%s  %s\n", indent, frame)
+	}
+}
+
+// errorsReport is the error groups, most recently seen first.
+type errorsReport struct {
+	XMLName xml.Name           `json:"-" xml:"errors" yaml:"-"`
+	Total   int64              `json:"total" xml:"total" yaml:"total"`
+	Groups  []errorGroupReport `json:"groups" xml:"error_group" yaml:"groups"`
+}
+
+// String returns the report as a summary line followed by each group.
+func (er errorsReport) String() string {
+	buffer := bytes.NewBuffer(nil)
+	fmt.Fprintf(buffer, "Errors: %d in %d groups\n", er.Total, len(er.Groups))
+	for _, group := range er.Groups {
+		buffer.WriteRune('\n')
+		group.writeTo(buffer, "  ")
+	}
+	return buffer.String()
+}
+
+// newErrorGroupReport returns the report for an error group, with its stack if `withStack` is set.
+func newErrorGroupReport(group web.ErrorGroup, withStack bool) errorGroupReport {
+	report := errorGroupReport{
+		Key:          group.Key,
+		Event:        string(group.Event),
+		Message:      group.Message,
+		Frame:        group.Frame,
+		Count:        group.Count,
+		FirstSeenUTC: group.FirstSeen.UTC(),
+		LastSeenUTC:  group.LastSeen.UTC(),
+	}
+	if group.Sample != nil {
+		report.Sample = &errorSampleReport{
+			Method:     group.Sample.Method,
+			URL:        group.Sample.URL,
+			Route:      group.Sample.Route,
+			RemoteAddr: group.Sample.RemoteAddr,
+			RequestID:  group.Sample.RequestID,
+			Headers:    headers(group.Sample.Header),
+		}
+	}
+	if withStack {
+		report.Stack = group.Stack
+	}
+	return report
+}
+
+// newErrorsReport returns the report for an aggregator's error groups.
+func newErrorsReport(aggregator *web.ErrorAggregator) errorsReport {
+	report := errorsReport{Groups: []errorGroupReport{}}
+	for _, group := range aggregator.Groups() {
+		report.Total += group.Count
+		report.Groups = append(report.Groups, newErrorGroupReport(group, false))
+	}
+	return report
+}
+
+// registerErrors adds `/_admin/errors`, the error groups, `/_admin/errors/{key}`, a group with its stack,
+// and `DELETE /_admin/errors`, which forgets them.
+func registerErrors(app *web.App, admin web.Middleware, aggregator *web.ErrorAggregator) {
+	app.GET("/_admin/errors", func(r *web.Ctx) web.Result {
+		return r.Negotiated().Result(newErrorsReport(aggregator))
+	}, admin)
+	app.GET("/_admin/errors/:key", func(r *web.Ctx) web.Result {
+		for _, group := range aggregator.Groups() {
+			if group.Key == r.Param("key") {
+				return r.Negotiated().Result(newErrorGroupReport(group, true))
+			}
+		}
+		return r.Negotiated().NotFound()
+	}, admin)
+	app.DELETE("/_admin/errors", func(r *web.Ctx) web.Result {
+		aggregator.Reset()
+		return r.Negotiated().Result(newErrorsReport(aggregator))
+	}, admin)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	web "github.com/blendlabs/go-web"
+)
+
+const (
+	// authRealm is the realm the auth endpoints challenge with.
+	authRealm = "echo"
+
+	// headerAuthorization is the request header carrying credentials.
+	headerAuthorization = "Authorization"
+	// headerWWWAuthenticate is the response header carrying a challenge.
+	headerWWWAuthenticate = "WWW-Authenticate"
+
+	// digestNonceTTL is how long a digest nonce is valid before it is reported as stale.
+	digestNonceTTL = 5 * time.Minute
+)
+
+// authReport is the outcome of an authentication attempt.
+type authReport struct {
+	Authenticated bool   `json:"authenticated" xml:"authenticated" yaml:"authenticated"`
+	Scheme        string `json:"scheme" xml:"scheme" yaml:"scheme"`
+	User          string `json:"user,omitempty" xml:"user,omitempty" yaml:"user,omitempty"`
+	Token         string `json:"token,omitempty" xml:"token,omitempty" yaml:"token,omitempty"`
+	Error         string `json:"error,omitempty" xml:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// String returns the report as `Key: value` lines.
+func (ar authReport) String() string {
+	buffer := bytes.NewBuffer(nil)
+	fmt.Fprintf(buffer, "Authenticated: %v\n", ar.Authenticated)
+	fmt.Fprintf(buffer, "Scheme: %s\n", ar.Scheme)
+	if len(ar.User) > 0 {
+		fmt.Fprintf(buffer, "User: %s\n", ar.User)
+	}
+	if len(ar.Token) > 0 {
+		fmt.Fprintf(buffer, "Token: %s\n", ar.Token)
+	}
+	if len(ar.Error) > 0 {
+		fmt.Fprintf(buffer, "Error: %s\n", ar.Error)
+	}
+	return buffer.String()
+}
+
+// challenge writes a `WWW-Authenticate` challenge and a 401 report.
+func challenge(r *web.Ctx, scheme, wwwAuthenticate, message string) web.Result {
+	r.Response.Header().Set(headerWWWAuthenticate, wwwAuthenticate)
+	return r.Negotiated().ResultWithStatus(http.StatusUnauthorized, authReport{Scheme: scheme, Error: message})
+}
+
+// authorization splits the `Authorization` header into its scheme and credentials.
+func authorization(r *web.Ctx) (scheme, credentials string) {
+	header := strings.TrimSpace(r.Request.Header.Get(headerAuthorization))
+	if index := strings.IndexAny(header, " \t"); index > 0 {
+		return header[:index], strings.TrimSpace(header[index+1:])
+	}
+	return header, ""
+}
+
+func constantTimeEquals(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// requireAdminToken returns the middleware for the `/_admin` routes, which only runs the action for requests
+// with `Authorization: Bearer <token>`.
+func requireAdminToken(token string) web.Middleware {
+	wwwAuthenticate := fmt.Sprintf(`Bearer realm="%s admin"`, authRealm)
+	return func(action web.Action) web.Action {
+		return func(r *web.Ctx) web.Result {
+			scheme, credentials := authorization(r)
+			if len(scheme) == 0 {
+				return challenge(r, "bearer", wwwAuthenticate, "missing admin token")
+			}
+			if !strings.EqualFold(scheme, "Bearer") || !constantTimeEquals(credentials, token) {
+				return challenge(r, "bearer", wwwAuthenticate+`, error="invalid_token"`, "invalid admin token")
+			}
+			return action(r)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------
+// Basic
+// --------------------------------------------------------------------------------
+
+// authBasic is `/auth/basic/:user/:pass`.
+func authBasic(r *web.Ctx) web.Result {
+	expectedUser, _ := r.RouteParam("user")
+	expectedPassword, _ := r.RouteParam("pass")
+	wwwAuthenticate := fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, authRealm)
+
+	scheme, _ := authorization(r)
+	if len(scheme) == 0 {
+		return challenge(r, "basic", wwwAuthenticate, "missing credentials")
+	}
+	user, password, ok := r.Request.BasicAuth()
+	if !ok {
+		return challenge(r, "basic", wwwAuthenticate, "malformed basic credentials")
+	}
+	// evaluate both comparisons so timing doesn't reveal which one failed.
+	userMatches := constantTimeEquals(user, expectedUser)
+	passwordMatches := constantTimeEquals(password, expectedPassword)
+	if !userMatches || !passwordMatches {
+		return challenge(r, "basic", wwwAuthenticate, "invalid credentials")
+	}
+	return r.Negotiated().Result(authReport{Authenticated: true, Scheme: "basic", User: user})
+}
+
+// --------------------------------------------------------------------------------
+// Bearer
+// --------------------------------------------------------------------------------
+
+// authBearer is `/auth/bearer`; any token is accepted unless `?token=` names the expected one.
+func authBearer(r *web.Ctx) web.Result {
+	wwwAuthenticate := fmt.Sprintf(`Bearer realm="%s"`, authRealm)
+
+	scheme, token := authorization(r)
+	if len(scheme) == 0 {
+		return challenge(r, "bearer", wwwAuthenticate, "missing credentials")
+	}
+	if !strings.EqualFold(scheme, "Bearer") || len(token) == 0 {
+		return challenge(r, "bearer", wwwAuthenticate+`, error="invalid_request"`, "malformed bearer credentials")
+	}
+	if expected := r.Request.URL.Query().Get("token"); len(expected) > 0 && !constantTimeEquals(token, expected) {
+		return challenge(r, "bearer", wwwAuthenticate+`, error="invalid_token"`, "invalid token")
+	}
+	return r.Negotiated().Result(authReport{Authenticated: true, Scheme: "bearer", Token: token})
+}
+
+// --------------------------------------------------------------------------------
+// Digest
+// --------------------------------------------------------------------------------
+
+// digestHashes are the supported digest algorithms.
+var digestHashes = map[string]func() hash.Hash{
+	"MD5":          md5.New,
+	"MD5-sess":     md5.New,
+	"SHA-256":      sha256.New,
+	"SHA-256-sess": sha256.New,
+}
+
+// newDigestAuth returns a new digest authenticator with a random nonce secret.
+func newDigestAuth() *digestAuth {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &digestAuth{
+		secret: secret,
+		nonces: map[string]*digestNonce{},
+	}
+}
+
+// digestAuth implements `/auth/digest/:qop/:user/:pass` (RFC 7616).
+// Nonces are signed with a server secret and carry their issue time, so only used nonces are tracked
+// (to check nonce counts and `?stale_after=` use limits).
+type digestAuth struct {
+	sync.Mutex
+	secret []byte
+	nonces map[string]*digestNonce
+}
+
+type digestNonce struct {
+	issued    time.Time
+	uses      int
+	lastCount uint64
+}
+
+// Action is the endpoint; `?algorithm=` selects MD5 (default), MD5-sess, SHA-256 or SHA-256-sess,
+// and `?stale_after=n` reports a nonce as stale once it has been used `n` times.
+func (da *digestAuth) Action(r *web.Ctx) web.Result {
+	qop, _ := r.RouteParam("qop")
+	expectedUser, _ := r.RouteParam("user")
+	expectedPassword, _ := r.RouteParam("pass")
+	if qop != "auth" && qop != "auth-int" {
+		return r.Negotiated().BadRequest(fmt.Sprintf("invalid qop `%s`; expected auth or auth-int", qop))
+	}
+	algorithm := r.Request.URL.Query().Get("algorithm")
+	if len(algorithm) == 0 {
+		algorithm = "MD5"
+	}
+	newHash, ok := digestHashes[algorithm]
+	if !ok {
+		return r.Negotiated().BadRequest(fmt.Sprintf("invalid algorithm `%s`; expected MD5, MD5-sess, SHA-256 or SHA-256-sess", algorithm))
+	}
+	staleAfter := 0
+	if value := r.Request.URL.Query().Get("stale_after"); len(value) > 0 {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			return r.Negotiated().BadRequest(fmt.Sprintf("invalid stale_after `%s`", value))
+		}
+		staleAfter = parsed
+	}
+
+	fail := func(message string, stale bool) web.Result {
+		wwwAuthenticate := fmt.Sprintf(`Digest realm="%s", qop="%s", algorithm=%s, nonce="%s", opaque="%s"`,
+			authRealm, qop, algorithm, da.issueNonce(), da.opaque())
+		if stale {
+			wwwAuthenticate = wwwAuthenticate + ", stale=true"
+		}
+		return challenge(r, "digest", wwwAuthenticate, message)
+	}
+
+	scheme, credentials := authorization(r)
+	if len(scheme) == 0 {
+		return fail("missing credentials", false)
+	}
+	if !strings.EqualFold(scheme, "Digest") {
+		return fail("malformed digest credentials", false)
+	}
+	params := parseDigestParams(credentials)
+	for _, required := range []string{"username", "realm", "nonce", "uri", "response", "qop", "nc", "cnonce"} {
+		if len(params[required]) == 0 {
+			return fail(fmt.Sprintf("malformed digest credentials; missing `%s`", required), false)
+		}
+	}
+	if params["realm"] != authRealm || params["qop"] != qop || params["uri"] != r.Request.RequestURI {
+		return fail("digest realm, qop or uri mismatch", false)
+	}
+	if value, hasAlgorithm := params["algorithm"]; hasAlgorithm && value != algorithm {
+		return fail("digest algorithm mismatch", false)
+	}
+	if value, hasOpaque := params["opaque"]; hasOpaque && value != da.opaque() {
+		return fail("digest opaque mismatch", false)
+	}
+	nonceCount, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil {
+		return fail("malformed nonce count", false)
+	}
+
+	var body []byte
+	if qop == "auth-int" {
+		if body, err = r.PostBody(); err != nil {
+			return r.Negotiated().InternalError(err)
+		}
+	}
+	h := func(value string) string {
+		hasher := newHash()
+		hasher.Write([]byte(value))
+		return hex.EncodeToString(hasher.Sum(nil))
+	}
+	ha1 := h(params["username"] + ":" + authRealm + ":" + expectedPassword)
+	if strings.HasSuffix(algorithm, "-sess") {
+		ha1 = h(ha1 + ":" + params["nonce"] + ":" + params["cnonce"])
+	}
+	ha2 := h(r.Request.Method + ":" + params["uri"])
+	if qop == "auth-int" {
+		ha2 = h(r.Request.Method + ":" + params["uri"] + ":" + h(string(body)))
+	}
+	expected := h(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], qop, ha2}, ":"))
+
+	userMatches := constantTimeEquals(params["username"], expectedUser)
+	responseMatches := constantTimeEquals(params["response"], expected)
+	if !userMatches || !responseMatches {
+		return fail("invalid credentials", false)
+	}
+
+	switch da.useNonce(params["nonce"], nonceCount, staleAfter) {
+	case digestNonceInvalid:
+		return fail("invalid nonce", false)
+	case digestNonceReplayed:
+		return fail("nonce count replayed", false)
+	case digestNonceStale:
+		return fail("stale nonce", true)
+	}
+	return r.Negotiated().Result(authReport{Authenticated: true, Scheme: "digest", User: params["username"]})
+}
+
+type digestNonceResult int
+
+const (
+	digestNonceValid digestNonceResult = iota
+	digestNonceInvalid
+	digestNonceReplayed
+	digestNonceStale
+)
+
+// issueNonce returns a new nonce: the issue time and an hmac of it, hex encoded.
+func (da *digestAuth) issueNonce() string {
+	issued := make([]byte, 8)
+	binary.BigEndian.PutUint64(issued, uint64(time.Now().UTC().UnixNano()))
+	return hex.EncodeToString(issued) + hex.EncodeToString(da.sign(issued))
+}
+
+// opaque is a constant per authenticator, derived from the secret.
+func (da *digestAuth) opaque() string {
+	return hex.EncodeToString(da.sign([]byte("opaque")))
+}
+
+func (da *digestAuth) sign(value []byte) []byte {
+	mac := hmac.New(sha256.New, da.secret)
+	mac.Write(value)
+	return mac.Sum(nil)[:16]
+}
+
+// useNonce validates a nonce and records its use.
+func (da *digestAuth) useNonce(nonce string, nonceCount uint64, staleAfter int) digestNonceResult {
+	raw, err := hex.DecodeString(nonce)
+	if err != nil || len(raw) != 24 || !hmac.Equal(raw[8:], da.sign(raw[:8])) {
+		return digestNonceInvalid
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(raw[:8]))).UTC()
+	now := time.Now().UTC()
+	if now.Sub(issued) > digestNonceTTL {
+		return digestNonceStale
+	}
+
+	da.Lock()
+	defer da.Unlock()
+	for key, used := range da.nonces {
+		if now.Sub(used.issued) > digestNonceTTL {
+			delete(da.nonces, key)
+		}
+	}
+	used, hasUsed := da.nonces[nonce]
+	if !hasUsed {
+		used = &digestNonce{issued: issued}
+		da.nonces[nonce] = used
+	}
+	if nonceCount <= used.lastCount {
+		return digestNonceReplayed
+	}
+	if staleAfter > 0 && used.uses >= staleAfter {
+		return digestNonceStale
+	}
+	used.lastCount = nonceCount
+	used.uses++
+	return digestNonceValid
+}
+
+// parseDigestParams parses the comma separated `key=value` (or `key="quoted value"`) pairs of a digest header.
+func parseDigestParams(value string) map[string]string {
+	params := map[string]string{}
+	for len(value) > 0 {
+		value = strings.TrimLeft(value, " \t,")
+		equals := strings.Index(value, "=")
+		if equals < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(value[:equals]))
+		value = strings.TrimLeft(value[equals+1:], " \t")
+
+		var param string
+		if strings.HasPrefix(value, `"`) {
+			buffer := bytes.NewBuffer(nil)
+			index := 1
+			for ; index < len(value) && value[index] != '"'; index++ {
+				if value[index] == '\\' && index+1 < len(value) {
+					index++
+				}
+				buffer.WriteByte(value[index])
+			}
+			param = buffer.String()
+			if index < len(value) {
+				index++
+			}
+			value = value[index:]
+		} else if comma := strings.Index(value, ","); comma >= 0 {
+			param, value = strings.TrimSpace(value[:comma]), value[comma:]
+		} else {
+			param, value = strings.TrimSpace(value), ""
+		}
+		params[key] = param
+	}
+	return params
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/blendlabs/go-logger"
+	util "github.com/blendlabs/go-util"
+	web "github.com/blendlabs/go-web"
+	workqueue "github.com/blendlabs/go-workqueue"
+)
+
+const (
+	callbackStatusScheduled = "scheduled"
+	callbackStatusRunning   = "running"
+	callbackStatusRetrying  = "retrying"
+	callbackStatusSucceeded = "succeeded"
+	callbackStatusFailed    = "failed"
+	callbackStatusAbandoned = "abandoned"
+
+	// callbackWorkers is the number of callbacks delivered concurrently.
+	callbackWorkers = 4
+	// callbackHistory is the number of callbacks kept; the oldest finished callbacks are dropped past it.
+	callbackHistory = 1024
+	// callbackMaxDelay is the longest a callback (or a retry) can be scheduled out.
+	callbackMaxDelay = 24 * time.Hour
+	// callbackMaxAttempts is the most attempts a retry policy can ask for.
+	callbackMaxAttempts = 20
+	// callbackDefaultTimeout is the default timeout of each attempt.
+	callbackDefaultTimeout = 30 * time.Second
+	// callbackResponseBodyLimit is how much of each response body is kept.
+	callbackResponseBodyLimit = 64 << 10
+
+	// callbacksCollection is the persistence collection callbacks are kept in, by id.
+	callbacksCollection = "callbacks"
+)
+
+// callbackDuration is a duration that decodes from json as a duration string (`"1.5s"`) or a number of seconds.
+type callbackDuration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (cd *callbackDuration) UnmarshalJSON(contents []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(contents, &value); err != nil {
+		return err
+	}
+	switch typed := value.(type) {
+	case string:
+		duration, err := time.ParseDuration(typed)
+		if err != nil {
+			return err
+		}
+		*cd = callbackDuration(duration)
+	case float64:
+		*cd = callbackDuration(time.Duration(typed * float64(time.Second)))
+	default:
+		return fmt.Errorf("invalid duration %s; expected a string like `1.5s` or seconds", string(contents))
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, as a duration string so it decodes back to the same duration.
+func (cd callbackDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(cd).String())
+}
+
+// callbackRetryPolicy is when and how often a failed callback is retried.
+type callbackRetryPolicy struct {
+	MaxAttempts int              `json:"max_attempts"`
+	Backoff     callbackDuration `json:"backoff"`
+	Multiplier  float64          `json:"multiplier"`
+	RetryOn     []int            `json:"retry_on"` // status codes to retry; defaults to any non 2xx.
+}
+
+// callbackRequest is the body of `POST /callback`.
+type callbackRequest struct {
+	URL        string              `json:"url"`
+	Method     string              `json:"method"`
+	Headers    map[string]string   `json:"headers"`
+	Body       string              `json:"body"`
+	BodyBase64 string              `json:"body_base64"`
+	Delay      callbackDuration    `json:"delay"`
+	Timeout    callbackDuration    `json:"timeout"`
+	Retry      callbackRetryPolicy `json:"retry"`
+}
+
+// callbackAttempt is a delivery attempt.
+type callbackAttempt struct {
+	Number     int       `json:"number" xml:"number" yaml:"number"`
+	StartedUTC time.Time `json:"started_utc" xml:"started_utc" yaml:"started_utc"`
+	Elapsed    string    `json:"elapsed" xml:"elapsed" yaml:"elapsed"`
+	StatusCode int       `json:"status_code,omitempty" xml:"status_code,omitempty" yaml:"status_code,omitempty"`
+	Headers    headers   `json:"headers,omitempty" xml:"headers,omitempty" yaml:"headers,omitempty"`
+	Body       string    `json:"body,omitempty" xml:"body,omitempty" yaml:"body,omitempty"`
+	Error      string    `json:"error,omitempty" xml:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// callbackReport is what `/callback/{id}` knows about a callback.
+type callbackReport struct {
+	XMLName      xml.Name          `json:"-" xml:"callback" yaml:"-"`
+	ID           string            `json:"id" xml:"id" yaml:"id"`
+	RequestID    string            `json:"request_id,omitempty" xml:"request_id,omitempty" yaml:"request_id,omitempty"`
+	Status       string            `json:"status" xml:"status" yaml:"status"`
+	URL          string            `json:"url" xml:"url" yaml:"url"`
+	Method       string            `json:"method" xml:"method" yaml:"method"`
+	Headers      headers           `json:"headers,omitempty" xml:"headers,omitempty" yaml:"headers,omitempty"`
+	BodyBytes    int               `json:"body_bytes" xml:"body_bytes" yaml:"body_bytes"`
+	MaxAttempts  int               `json:"max_attempts" xml:"max_attempts" yaml:"max_attempts"`
+	CreatedUTC   time.Time         `json:"created_utc" xml:"created_utc" yaml:"created_utc"`
+	NextUTC      *time.Time        `json:"next_attempt_utc,omitempty" xml:"next_attempt_utc,omitempty" yaml:"next_attempt_utc,omitempty"`
+	CompletedUTC *time.Time        `json:"completed_utc,omitempty" xml:"completed_utc,omitempty" yaml:"completed_utc,omitempty"`
+	Attempts     []callbackAttempt `json:"attempts" xml:"attempt" yaml:"attempts"`
+}
+
+// String returns the report as `Key: value` lines with an indented line per attempt.
+func (cr callbackReport) String() string {
+	buffer := bytes.NewBuffer(nil)
+	fmt.Fprintf(buffer, "ID: %s\n", cr.ID)
+	if len(cr.RequestID) > 0 {
+		fmt.Fprintf(buffer, "Request ID: %s\n", cr.RequestID)
+	}
+	fmt.Fprintf(buffer, "Status: %s\n", cr.Status)
+	fmt.Fprintf(buffer, "Request: %s %s\n", cr.Method, cr.URL)
+	if cr.NextUTC != nil {
+		fmt.Fprintf(buffer, "Next Attempt: %s\n", cr.NextUTC.Format(time.RFC3339))
+	}
+	if cr.CompletedUTC != nil {
+		fmt.Fprintf(buffer, "Completed: %s\n", cr.CompletedUTC.Format(time.RFC3339))
+	}
+	fmt.Fprintf(buffer, "Attempts: %d/%d\n", len(cr.Attempts), cr.MaxAttempts)
+	for _, attempt := range cr.Attempts {
+		if len(attempt.Error) > 0 {
+			fmt.Fprintf(buffer, "  #%d %s error: %s\n", attempt.Number, attempt.Elapsed, attempt.Error)
+		} else {
+			fmt.Fprintf(buffer, "  #%d %s %d\n", attempt.Number, attempt.Elapsed, attempt.StatusCode)
+		}
+	}
+	return buffer.String()
+}
+
+// callback is a scheduled outbound request.
+type callback struct {
+	report  callbackReport
+	body    []byte
+	timeout time.Duration
+	retry   callbackRetryPolicy
+}
+
+// persistedCallback is the persisted form of a callback.
+type persistedCallback struct {
+	Report  callbackReport      `json:"report"`
+	Body    []byte              `json:"body,omitempty"`
+	Timeout time.Duration       `json:"timeout"`
+	Retry   callbackRetryPolicy `json:"retry"`
+}
+
+// newCallbacks returns the callback endpoints and starts their queue.
+// Deliveries carry the id of the request that created them in the request id header; reports are redacted
+// with the redactor, while deliveries send the headers as given.
+// If a persistence is given, callbacks are also kept in it and loaded from it; callbacks that were still pending
+// are scheduled again, overdue ones right away.
+func newCallbacks(requestIDHeader string, redactor *logger.Redactor, persistence web.Persistence) (*callbacks, error) {
+	queue := workqueue.NewWithOptions(callbackWorkers, 1, callbackHistory)
+	queue.Start()
+	cb := &callbacks{
+		queue:           queue,
+		requestIDHeader: requestIDHeader,
+		redactor:        redactor,
+		persistence:     persistence,
+		callbacks:       map[string]*callback{},
+	}
+	if persistence != nil {
+		if err := cb.load(); err != nil {
+			queue.Close()
+			return nil, err
+		}
+	}
+	return cb, nil
+}
+
+// callbacks makes delayed outbound requests; deliveries (and retries) are delayed jobs on a work queue, due after the delay (or backoff).
+type callbacks struct {
+	queue           *workqueue.Queue
+	requestIDHeader string
+	redactor        *logger.Redactor
+	persistence     web.Persistence
+
+	lock      sync.Mutex
+	callbacks map[string]*callback
+	order     []string // callback ids, oldest first.
+}
+
+// Register adds the callback routes to an app.
+func (cb *callbacks) Register(app *web.App) {
+	app.POST("/callback", cb.create)
+	app.GET("/callback/:id", cb.get)
+}
+
+// Shutdown stops accepting callbacks and waits for the ones that are due to be delivered, until the context is done.
+// Callbacks waiting out a delay or a retry backoff are abandoned, unless there is a persistence to resume them from
+// on the next start (so they aren't reported as abandoned either).
+func (cb *callbacks) Shutdown(ctx context.Context) error {
+	err := cb.queue.Shutdown(ctx)
+	summary, ok := err.(*workqueue.ShutdownError)
+	if !ok {
+		return err
+	}
+	if cb.persistence != nil {
+		if summary.Err == nil && summary.InFlight == 0 && len(summary.Failed) == 0 && summary.Panics == 0 {
+			return nil
+		}
+		return err
+	}
+	cb.lock.Lock()
+	for _, entry := range summary.Abandoned {
+		if abandoned, ok := entry.Args[0].(*callback); ok {
+			cb.abandonLocked(abandoned)
+		}
+	}
+	cb.lock.Unlock()
+	return err
+}
+
+// create schedules a callback from a json `callbackRequest` and responds 202 with its report.
+func (cb *callbacks) create(r *web.Ctx) web.Result {
+	var request callbackRequest
+	body, err := r.PostBody()
+	if err != nil {
+		return r.Negotiated().InternalError(err)
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return r.Negotiated().BadRequest(fmt.Sprintf("invalid callback: %v", err))
+	}
+	created, err := newCallback(request)
+	if err != nil {
+		return r.Negotiated().BadRequest(err.Error())
+	}
+	created.report.RequestID = r.RequestID()
+	// the first attempt is scheduled before the callback is added so the 202 report carries it.
+	next := time.Now().UTC().Add(time.Duration(request.Delay))
+	created.report.NextUTC = &next
+
+	cb.lock.Lock()
+	dropped := cb.trimLocked(callbackHistory - 1)
+	if len(cb.order) >= callbackHistory {
+		cb.lock.Unlock()
+		cb.unpersist(dropped)
+		return r.Negotiated().ResultWithStatus(http.StatusServiceUnavailable, fmt.Sprintf("too many pending callbacks; at most %d", callbackHistory))
+	}
+	cb.callbacks[created.report.ID] = created
+	cb.order = append(cb.order, created.report.ID)
+	report := cb.reportLocked(created)
+	persisted := cb.persistedLocked(created)
+	cb.lock.Unlock()
+
+	cb.unpersist(dropped)
+	if err := cb.persist(created.report.ID, persisted); err != nil {
+		cb.lock.Lock()
+		cb.removeLocked(created.report.ID)
+		cb.lock.Unlock()
+		return r.Negotiated().InternalError(err)
+	}
+
+	r.Response.Header().Set("Location", "/callback/"+created.report.ID)
+	if !cb.queue.EnqueueAt(next, cb.deliver, created) {
+		cb.lock.Lock()
+		cb.abandonLocked(created)
+		report = cb.reportLocked(created)
+		persisted = cb.persistedLocked(created)
+		cb.lock.Unlock()
+		cb.persist(created.report.ID, persisted)
+		return r.Negotiated().ResultWithStatus(http.StatusServiceUnavailable, report)
+	}
+	return r.Negotiated().ResultWithStatus(http.StatusAccepted, report)
+}
+
+// get reports a callback's attempts and status.
+func (cb *callbacks) get(r *web.Ctx) web.Result {
+	cb.lock.Lock()
+	existing, hasCallback := cb.callbacks[r.Param("id")]
+	var report callbackReport
+	if hasCallback {
+		report = cb.reportLocked(existing)
+	}
+	cb.lock.Unlock()
+
+	if !hasCallback {
+		return r.Negotiated().NotFound()
+	}
+	return r.Negotiated().Result(report)
+}
+
+// newCallback validates a callback request.
+func newCallback(request callbackRequest) (*callback, error) {
+	target, err := url.Parse(request.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || len(target.Host) == 0 {
+		return nil, fmt.Errorf("invalid url `%s`; expected an absolute http or https url", request.URL)
+	}
+	method := strings.ToUpper(request.Method)
+	if len(method) == 0 {
+		method = http.MethodPost
+	}
+	body := []byte(request.Body)
+	if len(request.BodyBase64) > 0 {
+		if body, err = web.Base64.Decode(request.BodyBase64); err != nil {
+			return nil, fmt.Errorf("invalid body_base64: %v", err)
+		}
+	}
+	if request.Delay < 0 || time.Duration(request.Delay) > callbackMaxDelay {
+		return nil, fmt.Errorf("invalid delay; expected between 0 and %v", callbackMaxDelay)
+	}
+
+	retry := request.Retry
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = 1
+	}
+	if retry.MaxAttempts > callbackMaxAttempts {
+		return nil, fmt.Errorf("invalid retry.max_attempts; expected at most %d", callbackMaxAttempts)
+	}
+	if retry.Backoff < 0 || time.Duration(retry.Backoff) > callbackMaxDelay {
+		return nil, fmt.Errorf("invalid retry.backoff; expected between 0 and %v", callbackMaxDelay)
+	}
+	if retry.Multiplier < 1 {
+		retry.Multiplier = 1
+	}
+	timeout := time.Duration(request.Timeout)
+	if timeout <= 0 {
+		timeout = callbackDefaultTimeout
+	}
+
+	requestHeaders := headers{}
+	for name, value := range request.Headers {
+		http.Header(requestHeaders).Set(name, value)
+	}
+	return &callback{
+		report: callbackReport{
+			ID:          util.UUIDv4().ToShortString(),
+			Status:      callbackStatusScheduled,
+			URL:         target.String(),
+			Method:      method,
+			Headers:     requestHeaders,
+			BodyBytes:   len(body),
+			MaxAttempts: retry.MaxAttempts,
+			CreatedUTC:  time.Now().UTC(),
+			Attempts:    []callbackAttempt{},
+		},
+		body:    body,
+		timeout: timeout,
+		retry:   retry,
+	}, nil
+}
+
+// deliver makes a delivery attempt and schedules a retry if it failed; it never returns an error since
+// retries wait out the backoff rather than going straight back on the queue. A retry the queue doesn't take,
+// i.e. because it is shutting down, is abandoned unless there is a persistence to resume it from.
+// The callback is persisted after each attempt; a callback interrupted mid-attempt is attempted again on the next start.
+func (cb *callbacks) deliver(args ...interface{}) error {
+	delivering := args[0].(*callback)
+
+	cb.lock.Lock()
+	delivering.report.Status = callbackStatusRunning
+	delivering.report.NextUTC = nil
+	number := len(delivering.report.Attempts) + 1
+	cb.lock.Unlock()
+
+	attempt := cb.attempt(delivering, number)
+
+	cb.lock.Lock()
+	delivering.report.Attempts = append(delivering.report.Attempts, attempt)
+	if !delivering.retry.shouldRetry(attempt) {
+		delivering.report.Status = callbackStatusSucceeded
+		if len(attempt.Error) > 0 || attempt.StatusCode < 200 || attempt.StatusCode > 299 {
+			delivering.report.Status = callbackStatusFailed
+		}
+	} else if number >= delivering.retry.MaxAttempts {
+		delivering.report.Status = callbackStatusFailed
+	} else {
+		delivering.report.Status = callbackStatusRetrying
+		next := time.Now().UTC().Add(delivering.retry.backoff(number))
+		delivering.report.NextUTC = &next
+		persisted := cb.persistedLocked(delivering)
+		cb.lock.Unlock()
+
+		cb.persist(delivering.report.ID, persisted)
+		if !cb.queue.EnqueueAt(next, cb.deliver, delivering) && cb.persistence == nil {
+			cb.lock.Lock()
+			cb.abandonLocked(delivering)
+			cb.lock.Unlock()
+		}
+		return nil
+	}
+	completed := time.Now().UTC()
+	delivering.report.CompletedUTC = &completed
+	persisted := cb.persistedLocked(delivering)
+	cb.lock.Unlock()
+
+	cb.persist(delivering.report.ID, persisted)
+	return nil
+}
+
+// abandonLocked marks a callback that won't be attempted (again) as abandoned.
+func (cb *callbacks) abandonLocked(abandoned *callback) {
+	abandoned.report.Status = callbackStatusAbandoned
+	abandoned.report.NextUTC = nil
+	completed := time.Now().UTC()
+	abandoned.report.CompletedUTC = &completed
+}
+
+// attempt makes the outbound request.
+func (cb *callbacks) attempt(delivering *callback, number int) (attempt callbackAttempt) {
+	attempt = callbackAttempt{Number: number, StartedUTC: time.Now().UTC()}
+	defer func() {
+		elapsed := time.Since(attempt.StartedUTC)
+		attempt.Elapsed = (elapsed - elapsed%time.Millisecond).String()
+	}()
+
+	request, err := http.NewRequest(delivering.report.Method, delivering.report.URL, bytes.NewReader(delivering.body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	for name, values := range delivering.report.Headers {
+		request.Header[name] = values
+	}
+	if len(delivering.report.RequestID) > 0 && len(request.Header.Get(cb.requestIDHeader)) == 0 {
+		request.Header.Set(cb.requestIDHeader, delivering.report.RequestID)
+	}
+	request.Header.Set("X-Callback-ID", delivering.report.ID)
+	request.Header.Set("X-Callback-Attempt", strconv.Itoa(number))
+
+	client := &http.Client{Timeout: delivering.timeout}
+	response, err := client.Do(request)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer response.Body.Close()
+	responseBody, _ := ioutil.ReadAll(io.LimitReader(response.Body, callbackResponseBodyLimit))
+	attempt.StatusCode = response.StatusCode
+	attempt.Headers = headers(response.Header)
+	attempt.Body = string(responseBody)
+	return attempt
+}
+
+// shouldRetry returns if an attempt failed in a way the policy retries.
+func (crp callbackRetryPolicy) shouldRetry(attempt callbackAttempt) bool {
+	if len(attempt.Error) > 0 {
+		return true
+	}
+	if len(crp.RetryOn) == 0 {
+		return attempt.StatusCode < 200 || attempt.StatusCode > 299
+	}
+	for _, statusCode := range crp.RetryOn {
+		if statusCode == attempt.StatusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait after a given (1 based) failed attempt.
+func (crp callbackRetryPolicy) backoff(attempt int) time.Duration {
+	backoff := float64(crp.Backoff)
+	for x := 1; x < attempt; x++ {
+		backoff *= crp.Multiplier
+	}
+	if backoff > float64(callbackMaxDelay) {
+		return callbackMaxDelay
+	}
+	return time.Duration(backoff)
+}
+
+// reportLocked copies a callback's report, with its headers and attempt bodies redacted, so it can be rendered outside the lock.
+func (cb *callbacks) reportLocked(existing *callback) callbackReport {
+	report := existing.report
+	report.Headers = headers(cb.redactor.Header(http.Header(existing.report.Headers)))
+	report.Attempts = make([]callbackAttempt, len(existing.report.Attempts))
+	for index, attempt := range existing.report.Attempts {
+		attempt.Headers = headers(cb.redactor.Header(http.Header(attempt.Headers)))
+		attempt.Body = string(cb.redactor.Body([]byte(attempt.Body)))
+		report.Attempts[index] = attempt
+	}
+	return report
+}
+
+// trimLocked drops the oldest finished callbacks until at most `keep` remain, if it can, and returns their ids.
+func (cb *callbacks) trimLocked(keep int) (dropped []string) {
+	for index := 0; len(cb.order) > keep && index < len(cb.order); {
+		id := cb.order[index]
+		if !cb.callbacks[id].finished() {
+			index++
+			continue
+		}
+		delete(cb.callbacks, id)
+		cb.order = append(cb.order[:index], cb.order[index+1:]...)
+		dropped = append(dropped, id)
+	}
+	return dropped
+}
+
+// removeLocked drops a callback.
+func (cb *callbacks) removeLocked(id string) {
+	delete(cb.callbacks, id)
+	for index, existing := range cb.order {
+		if existing == id {
+			cb.order = append(cb.order[:index], cb.order[index+1:]...)
+			break
+		}
+	}
+}
+
+// finished returns if a callback won't be attempted again.
+func (c *callback) finished() bool {
+	switch c.report.Status {
+	case callbackStatusSucceeded, callbackStatusFailed, callbackStatusAbandoned:
+		return true
+	}
+	return false
+}
+
+// persistedLocked returns the persisted form of a callback, or nil without a persistence, so it can be
+// written outside the lock.
+func (cb *callbacks) persistedLocked(existing *callback) []byte {
+	if cb.persistence == nil {
+		return nil
+	}
+	report := existing.report
+	report.Attempts = append([]callbackAttempt{}, existing.report.Attempts...)
+	contents, _ := json.Marshal(persistedCallback{
+		Report:  report,
+		Body:    existing.body,
+		Timeout: existing.timeout,
+		Retry:   existing.retry,
+	})
+	return contents
+}
+
+// persist writes a callback's persisted form, if there is a persistence.
+func (cb *callbacks) persist(id string, contents []byte) error {
+	if cb.persistence == nil || contents == nil {
+		return nil
+	}
+	return cb.persistence.Put(callbacksCollection, id, contents)
+}
+
+// unpersist deletes callbacks dropped from the history from the persistence.
+func (cb *callbacks) unpersist(dropped []string) {
+	if cb.persistence == nil {
+		return
+	}
+	for _, id := range dropped {
+		cb.persistence.Delete(callbacksCollection, id)
+	}
+}
+
+// load adds the persisted callbacks, oldest first, and schedules the ones that were still pending.
+func (cb *callbacks) load() error {
+	var loaded []*callback
+	err := cb.persistence.Each(callbacksCollection, func(_ string, value []byte) error {
+		var persisted persistedCallback
+		if err := json.Unmarshal(value, &persisted); err != nil {
+			return err
+		}
+		if persisted.Report.Attempts == nil {
+			persisted.Report.Attempts = []callbackAttempt{}
+		}
+		loaded = append(loaded, &callback{
+			report:  persisted.Report,
+			body:    persisted.Body,
+			timeout: persisted.Timeout,
+			retry:   persisted.Retry,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].report.CreatedUTC.Before(loaded[j].report.CreatedUTC)
+	})
+
+	now := time.Now().UTC()
+	cb.lock.Lock()
+	for _, existing := range loaded {
+		cb.callbacks[existing.report.ID] = existing
+		cb.order = append(cb.order, existing.report.ID)
+	}
+	dropped := cb.trimLocked(callbackHistory)
+	var pending []*callback
+	for _, id := range cb.order {
+		existing := cb.callbacks[id]
+		if existing.finished() {
+			continue
+		}
+		next := now
+		if existing.report.NextUTC != nil && existing.report.NextUTC.After(now) {
+			next = *existing.report.NextUTC
+		}
+		if len(existing.report.Attempts) == 0 {
+			existing.report.Status = callbackStatusScheduled
+		} else {
+			existing.report.Status = callbackStatusRetrying
+		}
+		existing.report.NextUTC = &next
+		pending = append(pending, existing)
+	}
+	cb.lock.Unlock()
+
+	cb.unpersist(dropped)
+	for _, existing := range pending {
+		cb.queue.EnqueueAt(*existing.report.NextUTC, cb.deliver, existing)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"time"
+
+	"github.com/blendlabs/go-util/env"
+	web "github.com/blendlabs/go-web"
+)
+
+// config is the service config file (`CONFIG_PATH`); keys echo doesn't use are ignored.
+type config struct {
+	OIDC        oidcConfig        `yaml:"oidc"`
+	JWT         jwtConfig         `yaml:"jwt"`
+	Session     sessionConfig     `yaml:"session"`
+	Persistence persistenceConfig `yaml:"persistence"`
+	Webhooks    webhooksConfig    `yaml:"webhooks"`
+	RequestID   requestIDConfig   `yaml:"request_id"`
+	Tracing     tracingConfig     `yaml:"tracing"`
+	RequestLog  requestLogConfig  `yaml:"request_log"`
+	Redaction   redactionConfig   `yaml:"redaction"`
+	Admin       adminConfig       `yaml:"admin"`
+}
+
+// adminConfig configures access to the `/_admin` routes, i.e.
+//
+//	admin:
+//	  token: s3cret   # or `ADMIN_TOKEN`; requests need `Authorization: Bearer s3cret`
+//
+// Without a token the `/_admin` routes are not served.
+type adminConfig struct {
+	Token string `yaml:"token"`
+}
+
+// TokenOrDefault returns the admin token, or `ADMIN_TOKEN` if it isn't configured.
+func (ac adminConfig) TokenOrDefault() string {
+	if len(ac.Token) > 0 {
+		return ac.Token
+	}
+	return env.Env().String("ADMIN_TOKEN")
+}
+
+// requestIDConfig configures the header request ids are read from, returned in and forwarded in, i.e.
+//
+//	request_id:
+//	  header: X-Correlation-ID   # defaults to X-Request-ID
+type requestIDConfig struct {
+	Header string `yaml:"header"`
+}
+
+// HeaderOrDefault returns the request id header.
+func (ric requestIDConfig) HeaderOrDefault() string {
+	if len(ric.Header) > 0 {
+		return ric.Header
+	}
+	return web.HeaderRequestID
+}
+
+// oidcConfig configures the mock OpenID Connect provider, i.e.
+//
+//	oidc:
+//	  enabled: true
+//	  issuer: http://localhost:8080   # defaults to the scheme and host of each request
+//	  subject: test-user              # overridden per authorization with `login_hint`
+//	  claims:
+//	    email: test-user@example.com
+//	    groups: [admin]
+//	  access_token_ttl: 1h
+//	  clients:
+//	  - client_id: my-service
+//	    client_secret: secret         # omit for a public (PKCE) client
+//	    redirect_uris: [http://localhost:3000/callback]
+//
+// With no clients configured, any client id, secret and redirect uri is accepted.
+type oidcConfig struct {
+	Enabled         bool                   `yaml:"enabled"`
+	Issuer          string                 `yaml:"issuer"`
+	Subject         string                 `yaml:"subject"`
+	Audience        string                 `yaml:"audience"`
+	Claims          map[string]interface{} `yaml:"claims"`
+	AccessTokenTTL  time.Duration          `yaml:"access_token_ttl"`
+	IDTokenTTL      time.Duration          `yaml:"id_token_ttl"`
+	RefreshTokenTTL time.Duration          `yaml:"refresh_token_ttl"`
+	Clients         []oidcClient           `yaml:"clients"`
+}
+
+// oidcClient is a registered OAuth2 client.
+type oidcClient struct {
+	ID           string   `yaml:"client_id"`
+	Secret       string   `yaml:"client_secret"`
+	RedirectURIs []string `yaml:"redirect_uris"`
+}
+
+// jwtConfig configures how `/jwt` verifies tokens, i.e.
+//
+//	jwt:
+//	  hs256_secret: secret
+//	  jwks_path: /var/secrets/jwks.json   # RS256 and ES256 keys, re-read on every request
+//	  issuer: https://issuer.example.com  # optional
+//	  audience: my-service                # optional; `?aud=` overrides it per request
+//	  cookie: access_token                # the cookie tokens are read from
+//	  leeway: 30s                         # clock skew allowed for exp, nbf and iat
+type jwtConfig struct {
+	HS256Secret string        `yaml:"hs256_secret"`
+	JWKSPath    string        `yaml:"jwks_path"`
+	Issuer      string        `yaml:"issuer"`
+	Audience    string        `yaml:"audience"`
+	Cookie      string        `yaml:"cookie"`
+	Leeway      time.Duration `yaml:"leeway"`
+}
+
+// sessionConfig configures the `/session` endpoints' in memory session store, i.e.
+//
+//	session:
+//	  ttl: 30m                    # defaults to 24h
+//	  sliding_expiration: true
+//	  max_sessions_per_user: 3    # the oldest session is logged out past the limit
+//	  secret: <base64>            # signs the secure session id; random per process if unset
+type sessionConfig struct {
+	TTL                time.Duration `yaml:"ttl"`
+	SlidingExpiration  bool          `yaml:"sliding_expiration"`
+	MaxSessionsPerUser int           `yaml:"max_sessions_per_user"`
+	Secret             string        `yaml:"secret"`
+}
+
+// persistenceConfig configures where echo keeps state (sessions, pending callbacks and the oidc keys and grants) across restarts, i.e.
+//
+//	persistence:
+//	  path: /var/lib/echo      # state is kept in memory only if unset
+//	  snapshot_interval: 5m    # how often the append only log is compacted
+type persistenceConfig struct {
+	Path             string        `yaml:"path"`
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+}
+
+// webhooksConfig configures the `/webhooks` signature schemes, by name, i.e.
+//
+//	webhooks:
+//	  schemes:
+//	    stripe:
+//	      secret: whsec_...
+//	    partner:                           # served at /webhooks/verify/partner
+//	      type: generic                    # generic, github, stripe, slack, shopify or standard
+//	      secret: s3cret
+//	      header: X-Partner-Signature
+//	      timestamp_header: X-Partner-Timestamp
+//	      tolerance: 10m                   # the replay window; defaults to 5m
+//
+// Built in types work without being configured, with the secret given as `?secret=`.
+type webhooksConfig struct {
+	Schemes map[string]webhookSchemeConfig `yaml:"schemes"`
+}
+
+// webhookSchemeConfig configures a webhook signature scheme; empty fields default to the type's.
+type webhookSchemeConfig struct {
+	Type            string        `yaml:"type"`
+	Secret          string        `yaml:"secret"`
+	Header          string        `yaml:"header"`
+	TimestampHeader string        `yaml:"timestamp_header"`
+	IDHeader        string        `yaml:"id_header"`
+	Tolerance       time.Duration `yaml:"tolerance"`
+}
+
+// tracingConfig configures where the server span of each request is exported, i.e.
+//
+//	tracing:
+//	  service_name: echo                                  # defaults to echo
+//	  file: /var/log/echo/spans.jsonl                     # one json span per line
+//	  otlp_endpoint: http://localhost:4318/v1/traces      # or otlp/http json to a collector
+//	  otlp_headers:
+//	    Authorization: Bearer ...
+//	  flush_interval: 1s                                  # defaults to 5s
+//
+// Spans are started and propagated either way; with neither `file` nor `otlp_endpoint` set they aren't exported.
+type tracingConfig struct {
+	ServiceName   string            `yaml:"service_name"`
+	File          string            `yaml:"file"`
+	OTLPEndpoint  string            `yaml:"otlp_endpoint"`
+	OTLPHeaders   map[string]string `yaml:"otlp_headers"`
+	FlushInterval time.Duration     `yaml:"flush_interval"`
+}
+
+// requestLogConfig configures which requests' events are logged, per route, i.e.
+//
+//	request_log:
+//	  default:
+//	    sample_rate: 10          # log 1 in 10 requests
+//	    slow_threshold: 500ms    # and any request slower than this (or failing with a 5xx)
+//	  routes:
+//	    - path: /status
+//	      policy:
+//	        exclude: true
+//	    - path: /upload
+//	      policy:
+//	        bodies: false
+//
+// Routes are matched in order by route path, request path, or request path prefix ending in `*`.
+// It is laid over the policies from `LOG_REQUEST_EXCLUDE`, `LOG_REQUEST_BODIES`, `LOG_REQUEST_SAMPLE_RATE`
+// and `LOG_REQUEST_SLOW_THRESHOLD`: the default sets what it sets on the environment's default policy (which logs
+// bodies unless `LOG_REQUEST_BODIES` names the routes that do), routes are matched before the environment's,
+// and what a route doesn't set is taken from the default.
+type requestLogConfig struct {
+	Default requestLogPolicyConfig  `yaml:"default"`
+	Routes  []requestLogRouteConfig `yaml:"routes"`
+}
+
+// requestLogPolicyConfig is a request log policy; fields that aren't set are inherited.
+type requestLogPolicyConfig struct {
+	Exclude       *bool          `yaml:"exclude"`
+	Bodies        *bool          `yaml:"bodies"`
+	SampleRate    *int           `yaml:"sample_rate"`
+	SlowThreshold *time.Duration `yaml:"slow_threshold"`
+}
+
+// requestLogRouteConfig is a request log policy for a path.
+type requestLogRouteConfig struct {
+	Path   string                 `yaml:"path"`
+	Policy requestLogPolicyConfig `yaml:"policy"`
+}
+
+// IsZero returns if the config doesn't set any policies.
+func (rlc requestLogConfig) IsZero() bool {
+	return rlc.Default == requestLogPolicyConfig{} && len(rlc.Routes) == 0
+}
+
+// Policies returns the request log policies from the environment with the config laid over them;
+// it returns nil (every request is logged, with bodies) if neither sets any.
+func (rlc requestLogConfig) Policies() (*web.RequestLogPolicies, error) {
+	policies, err := web.NewRequestLogPoliciesFromEnvironment()
+	if err != nil || rlc.IsZero() {
+		return policies, err
+	}
+	defaultPolicy := web.RequestLogPolicy{Bodies: true}
+	var routes []web.RequestLogRoute
+	if policies != nil {
+		defaultPolicy, routes = policies.Default(), policies.Routes()
+	}
+	defaultPolicy = rlc.Default.overlay(defaultPolicy)
+	configured := make([]web.RequestLogRoute, 0, len(rlc.Routes)+len(routes))
+	for _, route := range rlc.Routes {
+		configured = append(configured, web.RequestLogRoute{Path: route.Path, Policy: route.Policy.overlay(defaultPolicy)})
+	}
+	return web.NewRequestLogPolicies(defaultPolicy, append(configured, routes...)...), nil
+}
+
+// overlay returns a policy with the fields the config sets replaced.
+func (rlpc requestLogPolicyConfig) overlay(policy web.RequestLogPolicy) web.RequestLogPolicy {
+	if rlpc.Exclude != nil {
+		policy.Exclude = *rlpc.Exclude
+	}
+	if rlpc.Bodies != nil {
+		policy.Bodies = *rlpc.Bodies
+	}
+	if rlpc.SampleRate != nil {
+		policy.SampleRate = *rlpc.SampleRate
+	}
+	if rlpc.SlowThreshold != nil {
+		policy.SlowThreshold = *rlpc.SlowThreshold
+	}
+	return policy
+}
+
+// redactionConfig adds key patterns, headers and json body paths to what is redacted from logs, `/headers`,
+// `/config` and callback reports, i.e.
+//
+//	redaction:
+//	  keys:                # in addition to *SECRET*, *TOKEN*, *PASSWORD* and the like; `*` matches anything
+//	    - "*SSN*"
+//	  headers:             # in addition to Authorization, Cookie, Set-Cookie and the like
+//	    - X-Upstream-Auth
+//	  json_paths:
+//	    - $.card.number
+//	    - accounts[*].number
+type redactionConfig struct {
+	Keys      []string `yaml:"keys"`
+	Headers   []string `yaml:"headers"`
+	JSONPaths []string `yaml:"json_paths"`
+}
+
+// parseConfig parses the config file contents.
+func parseConfig(contents []byte) (*config, error) {
+	cfg := &config{}
+	if len(contents) == 0 {
+		return cfg, nil
+	}
+	if err := web.UnmarshalYAML(contents, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
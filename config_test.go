@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	web "github.com/blendlabs/go-web"
+)
+
+// setEnvironment sets (or, for empty values, unsets) environment variables and returns a func that restores them.
+func setEnvironment(values map[string]string) func() {
+	previous := map[string]*string{}
+	for name, value := range values {
+		if current, isSet := os.LookupEnv(name); isSet {
+			previous[name] = &current
+		} else {
+			previous[name] = nil
+		}
+		if len(value) > 0 {
+			os.Setenv(name, value)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+	return func() {
+		for name, value := range previous {
+			if value != nil {
+				os.Setenv(name, *value)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+	}
+}
+
+func TestRequestLogConfigPolicies(t *testing.T) {
+	testCases := []struct {
+		name            string
+		environment     map[string]string
+		config          string
+		expectedNil     bool
+		expectedDefault web.RequestLogPolicy
+		expectedRoutes  []web.RequestLogRoute
+	}{
+		{
+			name:        "neither",
+			expectedNil: true,
+		},
+		{
+			name:            "environment only",
+			environment:     map[string]string{web.EnvironmentVariableLogRequestExclude: "/status"},
+			expectedDefault: web.RequestLogPolicy{Bodies: true},
+			expectedRoutes:  []web.RequestLogRoute{{Path: "/status", Policy: web.RequestLogPolicy{Exclude: true}}},
+		},
+		{
+			name: "config only",
+			config: `
+request_log:
+  default:
+    sample_rate: 10
+  routes:
+  - path: /upload
+    policy:
+      bodies: false
+      slow_threshold: 2s
+`,
+			expectedDefault: web.RequestLogPolicy{Bodies: true, SampleRate: 10},
+			expectedRoutes: []web.RequestLogRoute{
+				{Path: "/upload", Policy: web.RequestLogPolicy{SampleRate: 10, SlowThreshold: 2 * time.Second}},
+			},
+		},
+		{
+			name: "config laid over the environment",
+			environment: map[string]string{
+				web.EnvironmentVariableLogRequestExclude:       "/status",
+				web.EnvironmentVariableLogRequestBodies:        "/echo/*filepath",
+				web.EnvironmentVariableLogRequestSampleRate:    "5",
+				web.EnvironmentVariableLogRequestSlowThreshold: "1s",
+			},
+			config: `
+request_log:
+  default:
+    slow_threshold: 500ms
+  routes:
+  - path: /status
+    policy:
+      exclude: false
+      sample_rate: 100
+  - path: /_admin/*
+    policy:
+      bodies: true
+`,
+			// the environment's default doesn't log bodies as LOG_REQUEST_BODIES is set; the config only sets the slow threshold.
+			expectedDefault: web.RequestLogPolicy{SampleRate: 5, SlowThreshold: 500 * time.Millisecond},
+			expectedRoutes: []web.RequestLogRoute{
+				{Path: "/status", Policy: web.RequestLogPolicy{SampleRate: 100, SlowThreshold: 500 * time.Millisecond}},
+				{Path: "/_admin/*", Policy: web.RequestLogPolicy{Bodies: true, SampleRate: 5, SlowThreshold: 500 * time.Millisecond}},
+				{Path: "/status", Policy: web.RequestLogPolicy{Exclude: true}},
+				{Path: "/echo/*filepath", Policy: web.RequestLogPolicy{Bodies: true, SampleRate: 5, SlowThreshold: time.Second}},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		environment := map[string]string{
+			web.EnvironmentVariableLogRequestExclude:       "",
+			web.EnvironmentVariableLogRequestBodies:        "",
+			web.EnvironmentVariableLogRequestSampleRate:    "",
+			web.EnvironmentVariableLogRequestSlowThreshold: "",
+		}
+		for name, value := range testCase.environment {
+			environment[name] = value
+		}
+		restore := setEnvironment(environment)
+
+		cfg, err := parseConfig([]byte(testCase.config))
+		if err != nil {
+			restore()
+			t.Fatalf("%s: %v", testCase.name, err)
+		}
+		policies, err := cfg.RequestLog.Policies()
+		restore()
+		if err != nil {
+			t.Errorf("%s: %v", testCase.name, err)
+			continue
+		}
+
+		if testCase.expectedNil {
+			if policies != nil {
+				t.Errorf("%s: expected no policies, got %+v", testCase.name, policies)
+			}
+			continue
+		}
+		if policies == nil {
+			t.Errorf("%s: expected policies", testCase.name)
+			continue
+		}
+		if policies.Default() != testCase.expectedDefault {
+			t.Errorf("%s: expected the default %+v, got %+v", testCase.name, testCase.expectedDefault, policies.Default())
+		}
+		if !reflect.DeepEqual(policies.Routes(), testCase.expectedRoutes) {
+			t.Errorf("%s: expected the routes %+v, got %+v", testCase.name, testCase.expectedRoutes, policies.Routes())
+		}
+	}
+}
+
+func TestRequestLogConfigPoliciesMatchConfigRoutesFirst(t *testing.T) {
+	defer setEnvironment(map[string]string{
+		web.EnvironmentVariableLogRequestExclude:       "/_admin/*",
+		web.EnvironmentVariableLogRequestBodies:        "",
+		web.EnvironmentVariableLogRequestSampleRate:    "",
+		web.EnvironmentVariableLogRequestSlowThreshold: "",
+	})()
+
+	cfg, err := parseConfig([]byte("request_log:\n  routes:\n  - path: /_admin/config\n    policy:\n      bodies: false\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := cfg.RequestLog.Policies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy := policies.Policy(nil, "/_admin/config"); policy.Exclude || policy.Bodies {
+		t.Errorf("expected the config route to be matched before the environment's, got %+v", policy)
+	}
+	if policy := policies.Policy(nil, "/_admin/sessions"); !policy.Exclude {
+		t.Errorf("expected the environment's routes to still apply, got %+v", policy)
+	}
+}
+
+func TestRequestLogConfigPoliciesErrors(t *testing.T) {
+	defer setEnvironment(map[string]string{web.EnvironmentVariableLogRequestSampleRate: "often"})()
+	cfg, err := parseConfig([]byte("request_log:\n  default:\n    sample_rate: 10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.RequestLog.Policies(); err == nil {
+		t.Error("expected an invalid environment to be an error")
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	web "github.com/blendlabs/go-web"
+)
+
+// cookieAttributes are the query parameters `/cookies/set` and `/cookies/delete` treat as cookie attributes
+// rather than cookie names (as is the negotiated `format` parameter).
+var cookieAttributes = map[string]bool{
+	"domain":      true,
+	"path":        true,
+	"expires":     true,
+	"max-age":     true,
+	"max_age":     true,
+	"secure":      true,
+	"httponly":    true,
+	"samesite":    true,
+	"partitioned": true,
+}
+
+// cookieValue is a single cookie name and value.
+type cookieValue struct {
+	Name  string `json:"name" xml:"name,attr" yaml:"name"`
+	Value string `json:"value" xml:",chardata" yaml:"value"`
+}
+
+// receivedCookies are the cookies sent with a request, in the order they were sent.
+type receivedCookies struct {
+	XMLName xml.Name      `json:"-" xml:"cookies" yaml:"-"`
+	Cookies []cookieValue `json:"cookies" xml:"cookie" yaml:"cookies"`
+}
+
+// String returns the cookies one `name=value` per line.
+func (rc receivedCookies) String() string {
+	buffer := bytes.NewBuffer(nil)
+	for _, cookie := range rc.Cookies {
+		buffer.WriteString(cookie.Name)
+		buffer.WriteRune('=')
+		buffer.WriteString(cookie.Value)
+		buffer.WriteRune('\n')
+	}
+	return buffer.String()
+}
+
+// setCookies are the `Set-Cookie` headers written by a response.
+type setCookies struct {
+	XMLName   xml.Name `json:"-" xml:"set_cookies" yaml:"-"`
+	SetCookie []string `json:"set_cookie" xml:"set_cookie" yaml:"set_cookie"`
+}
+
+// String returns the headers in wire format, one `Set-Cookie: ...` per line.
+func (sc setCookies) String() string {
+	buffer := bytes.NewBuffer(nil)
+	for _, value := range sc.SetCookie {
+		buffer.WriteString(web.HeaderSetCookie)
+		buffer.WriteString(": ")
+		buffer.WriteString(value)
+		buffer.WriteRune('\n')
+	}
+	return buffer.String()
+}
+
+// queryParameter is a query string parameter; `/cookies/set` keeps them in order so output is deterministic.
+type queryParameter struct {
+	Key      string
+	Value    string
+	HasValue bool
+}
+
+func orderedQuery(rawQuery string) ([]queryParameter, error) {
+	var parameters []queryParameter
+	for _, piece := range strings.Split(rawQuery, "&") {
+		if len(piece) == 0 {
+			continue
+		}
+		var parameter queryParameter
+		key := piece
+		if index := strings.Index(piece, "="); index >= 0 {
+			key = piece[:index]
+			value, err := url.QueryUnescape(piece[index+1:])
+			if err != nil {
+				return nil, err
+			}
+			parameter.Value = value
+			parameter.HasValue = true
+		}
+		key, err := url.QueryUnescape(key)
+		if err != nil {
+			return nil, err
+		}
+		parameter.Key = key
+		parameters = append(parameters, parameter)
+	}
+	return parameters, nil
+}
+
+// cookieTemplate reads the attribute parameters of a cookie request.
+// Flags (`secure`, `httponly`, `partitioned`) are set by being present, i.e. `?secure` or `?secure=true`.
+func cookieTemplate(parameters []queryParameter) (*web.Cookie, error) {
+	template := web.NewCookie("", "")
+	template.Path = "/"
+	for _, parameter := range parameters {
+		switch strings.ToLower(parameter.Key) {
+		case "domain":
+			template.Domain = parameter.Value
+		case "path":
+			template.Path = parameter.Value
+		case "expires":
+			expires, err := parseCookieExpires(parameter.Value)
+			if err != nil {
+				return nil, err
+			}
+			template.Expires = expires
+		case "max-age", "max_age":
+			maxAge, err := strconv.Atoi(parameter.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max-age `%s`", parameter.Value)
+			}
+			if maxAge <= 0 {
+				maxAge = -1 // `http.Cookie` writes `Max-Age=0` for negative values
+			}
+			template.MaxAge = maxAge
+		case "secure":
+			flag, err := parseCookieFlag(parameter)
+			if err != nil {
+				return nil, err
+			}
+			template.Secure = flag
+		case "httponly":
+			flag, err := parseCookieFlag(parameter)
+			if err != nil {
+				return nil, err
+			}
+			template.HttpOnly = flag
+		case "partitioned":
+			flag, err := parseCookieFlag(parameter)
+			if err != nil {
+				return nil, err
+			}
+			template.Partitioned = flag
+		case "samesite":
+			sameSite, ok := web.ParseSameSite(parameter.Value)
+			if !ok {
+				return nil, fmt.Errorf("invalid samesite `%s`; expected lax, strict or none", parameter.Value)
+			}
+			template.SameSite = sameSite
+		}
+	}
+	return template, nil
+}
+
+// parseCookieExpires parses an http date, an RFC3339 timestamp or a duration from now (i.e. `1h`).
+func parseCookieExpires(value string) (time.Time, error) {
+	if expires, err := http.ParseTime(value); err == nil {
+		return expires, nil
+	}
+	if expires, err := time.Parse(time.RFC3339, value); err == nil {
+		return expires, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().UTC().Add(duration), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expires `%s`; expected an http date, RFC3339 timestamp or duration", value)
+}
+
+func parseCookieFlag(parameter queryParameter) (bool, error) {
+	if !parameter.HasValue || len(parameter.Value) == 0 {
+		return true, nil
+	}
+	flag, err := strconv.ParseBool(parameter.Value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s `%s`", parameter.Key, parameter.Value)
+	}
+	return flag, nil
+}
+
+// cookies lists the cookies sent with the request.
+func cookies(r *web.Ctx) web.Result {
+	received := receivedCookies{Cookies: []cookieValue{}}
+	for _, cookie := range r.Request.Cookies() {
+		received.Cookies = append(received.Cookies, cookieValue{Name: cookie.Name, Value: cookie.Value})
+	}
+	return r.Negotiated().Result(received)
+}
+
+// cookiesSet sets each `name=value` query parameter as a cookie, with the attributes given by the remaining parameters.
+func cookiesSet(r *web.Ctx) web.Result {
+	parameters, err := orderedQuery(r.Request.URL.RawQuery)
+	if err != nil {
+		return r.Negotiated().BadRequest(err.Error())
+	}
+	template, err := cookieTemplate(parameters)
+	if err != nil {
+		return r.Negotiated().BadRequest(err.Error())
+	}
+	var toSet []web.Cookie
+	for _, parameter := range parameters {
+		if !isCookieName(parameter.Key) {
+			continue
+		}
+		cookie := *template
+		cookie.Name = parameter.Key
+		cookie.Value = parameter.Value
+		if len(cookie.String()) == 0 {
+			return r.Negotiated().BadRequest(fmt.Sprintf("invalid cookie name `%s`", parameter.Key))
+		}
+		toSet = append(toSet, cookie)
+	}
+	for index := range toSet {
+		r.WriteExtendedCookie(&toSet[index])
+	}
+	return r.Negotiated().Result(setCookies{SetCookie: writtenCookies(r)})
+}
+
+// cookiesDelete expires each named cookie (i.e. `?a&b`), with the attributes given by the remaining parameters.
+func cookiesDelete(r *web.Ctx) web.Result {
+	parameters, err := orderedQuery(r.Request.URL.RawQuery)
+	if err != nil {
+		return r.Negotiated().BadRequest(err.Error())
+	}
+	template, err := cookieTemplate(parameters)
+	if err != nil {
+		return r.Negotiated().BadRequest(err.Error())
+	}
+	for _, parameter := range parameters {
+		if !isCookieName(parameter.Key) {
+			continue
+		}
+		cookie := *template
+		cookie.Name = parameter.Key
+		r.ExpireExtendedCookie(&cookie)
+	}
+	return r.Negotiated().Result(setCookies{SetCookie: writtenCookies(r)})
+}
+
+func isCookieName(key string) bool {
+	return key != web.QueryParamFormat && !cookieAttributes[strings.ToLower(key)]
+}
+
+func writtenCookies(r *web.Ctx) []string {
+	written := r.Response.Header()[web.HeaderSetCookie]
+	if written == nil {
+		return []string{}
+	}
+	return written
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	web "github.com/blendlabs/go-web"
+)
+
+// encodingReport describes the content encodings negotiated for a request.
+type encodingReport struct {
+	AcceptEncoding         string `json:"accept_encoding" xml:"accept_encoding"`
+	Negotiated             string `json:"negotiated" xml:"negotiated"`
+	CompressionMinSize     int    `json:"compression_min_size" xml:"compression_min_size"`
+	RequestContentEncoding string `json:"request_content_encoding,omitempty" xml:"request_content_encoding,omitempty"`
+	RequestBodyBytes       int    `json:"request_body_bytes" xml:"request_body_bytes"`
+	Padding                string `json:"padding,omitempty" xml:"padding,omitempty"`
+}
+
+// String returns the report as `key: value` lines.
+func (er encodingReport) String() string {
+	lines := []string{
+		fmt.Sprintf("accept_encoding: %s", er.AcceptEncoding),
+		fmt.Sprintf("negotiated: %s", er.Negotiated),
+		fmt.Sprintf("compression_min_size: %d", er.CompressionMinSize),
+		fmt.Sprintf("request_content_encoding: %s", er.RequestContentEncoding),
+		fmt.Sprintf("request_body_bytes: %d", er.RequestBodyBytes),
+	}
+	if len(er.Padding) > 0 {
+		lines = append(lines, fmt.Sprintf("padding: %s", er.Padding))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// encoding reports the negotiated response encoding and the decoded request encoding.
+// Use `?size=` to pad the response so it crosses the compression minimum size.
+func encoding(r *web.Ctx) web.Result {
+	body, err := r.PostBody()
+	if err != nil {
+		return r.Negotiated().BadRequest(err.Error())
+	}
+
+	report := encodingReport{
+		AcceptEncoding:         r.Request.Header.Get(web.HeaderAcceptEncoding),
+		Negotiated:             r.ResponseContentEncoding(),
+		CompressionMinSize:     r.App().CompressionMinSize(),
+		RequestContentEncoding: r.RequestContentEncoding(),
+		RequestBodyBytes:       len(body),
+	}
+	if size, err := r.QueryParamInt("size"); err == nil && size > 0 {
+		report.Padding = strings.Repeat("x", size)
+	}
+	return r.Negotiated().Result(report)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// jwtHeader is the JOSE header of a JWT.
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// jwtToken is a decoded, but not necessarily verified, JWT.
+type jwtToken struct {
+	Header       jwtHeader
+	HeaderFields map[string]interface{}
+	Claims       map[string]interface{}
+	SigningInput string
+	Signature    []byte
+}
+
+// parseJWT decodes a compact serialized JWT; numeric claims are decoded as `json.Number`.
+func parseJWT(raw string) (*jwtToken, error) {
+	pieces := strings.Split(strings.TrimSpace(raw), ".")
+	if len(pieces) != 3 {
+		return nil, fmt.Errorf("malformed jwt; expected 3 segments, got %d", len(pieces))
+	}
+	headerJSON, err := base64URLDecode(pieces[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt header: %v", err)
+	}
+	claimsJSON, err := base64URLDecode(pieces[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt claims: %v", err)
+	}
+	signature, err := base64URLDecode(pieces[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt signature: %v", err)
+	}
+
+	token := &jwtToken{
+		SigningInput: pieces[0] + "." + pieces[1],
+		Signature:    signature,
+	}
+	if err := json.Unmarshal(headerJSON, &token.Header); err != nil {
+		return nil, fmt.Errorf("malformed jwt header: %v", err)
+	}
+	if err := json.Unmarshal(headerJSON, &token.HeaderFields); err != nil {
+		return nil, fmt.Errorf("malformed jwt header: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(claimsJSON))
+	decoder.UseNumber()
+	if err := decoder.Decode(&token.Claims); err != nil {
+		return nil, fmt.Errorf("malformed jwt claims: %v", err)
+	}
+	return token, nil
+}
+
+// verifyRS256 checks the token is RS256 signed by a given key.
+func (jt *jwtToken) verifyRS256(key *rsa.PublicKey) error {
+	if jt.Header.Algorithm != "RS256" {
+		return fmt.Errorf("unexpected jwt algorithm `%s`; expected RS256", jt.Header.Algorithm)
+	}
+	digest := sha256.Sum256([]byte(jt.SigningInput))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], jt.Signature); err != nil {
+		return fmt.Errorf("invalid jwt signature")
+	}
+	return nil
+}
+
+// verifyHS256 checks the token is HS256 signed with a given secret.
+func (jt *jwtToken) verifyHS256(secret []byte) error {
+	if jt.Header.Algorithm != "HS256" {
+		return fmt.Errorf("unexpected jwt algorithm `%s`; expected HS256", jt.Header.Algorithm)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(jt.SigningInput))
+	if !hmac.Equal(mac.Sum(nil), jt.Signature) {
+		return fmt.Errorf("invalid jwt signature")
+	}
+	return nil
+}
+
+// verifyES256 checks the token is ES256 signed by a given key; the signature is the fixed width `r || s` (RFC 7518 section 3.4).
+func (jt *jwtToken) verifyES256(key *ecdsa.PublicKey) error {
+	if jt.Header.Algorithm != "ES256" {
+		return fmt.Errorf("unexpected jwt algorithm `%s`; expected ES256", jt.Header.Algorithm)
+	}
+	if len(jt.Signature) != 64 {
+		return fmt.Errorf("invalid jwt signature; expected 64 bytes, got %d", len(jt.Signature))
+	}
+	digest := sha256.Sum256([]byte(jt.SigningInput))
+	r := new(big.Int).SetBytes(jt.Signature[:32])
+	s := new(big.Int).SetBytes(jt.Signature[32:])
+	if !ecdsa.Verify(key, digest[:], r, s) {
+		return fmt.Errorf("invalid jwt signature")
+	}
+	return nil
+}
+
+// claimTime returns a NumericDate claim (i.e. `exp`) as a time.
+func (jt *jwtToken) claimTime(name string) (time.Time, bool) {
+	switch value := jt.Claims[name].(type) {
+	case json.Number:
+		seconds, err := value.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(int64(seconds), 0).UTC(), true
+	case float64:
+		return time.Unix(int64(value), 0).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// signRS256 returns a compact serialized RS256 JWT.
+func signRS256(key *rsa.PrivateKey, keyID string, claims map[string]interface{}) (string, error) {
+	headerJSON, err := json.Marshal(jwtHeader{Algorithm: "RS256", Type: "JWT", KeyID: keyID})
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64URLEncode(headerJSON) + "." + base64URLEncode(claimsJSON)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64URLEncode(signature), nil
+}
+
+// jwk is a JSON web key (public parameters only).
+type jwk struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// publicKey returns the `*rsa.PublicKey` or `*ecdsa.PublicKey` (P-256 only) the jwk describes.
+func (j jwk) publicKey() (interface{}, error) {
+	switch j.KeyType {
+	case "RSA":
+		n, err := base64URLDecode(j.N)
+		if err != nil || len(n) == 0 {
+			return nil, fmt.Errorf("jwk `%s`: invalid modulus", j.KeyID)
+		}
+		e, err := base64URLDecode(j.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("jwk `%s`: invalid exponent", j.KeyID)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if j.Curve != "P-256" {
+			return nil, fmt.Errorf("jwk `%s`: unsupported curve `%s`", j.KeyID, j.Curve)
+		}
+		x, errX := base64URLDecode(j.X)
+		y, errY := base64URLDecode(j.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("jwk `%s`: invalid point", j.KeyID)
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("jwk `%s`: point is not on the curve", j.KeyID)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("jwk `%s`: unsupported key type `%s`", j.KeyID, j.KeyType)
+}
+
+// jwkSet is a JSON web key set.
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// newRSAJWK returns the jwk for an RS256 signing key.
+func newRSAJWK(keyID string, key *rsa.PublicKey) jwk {
+	return jwk{
+		KeyType:   "RSA",
+		Use:       "sig",
+		Algorithm: "RS256",
+		KeyID:     keyID,
+		N:         base64URLEncode(key.N.Bytes()),
+		E:         base64URLEncode(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// rsaThumbprint returns the RFC 7638 thumbprint of an rsa public key, which makes a stable key id.
+func rsaThumbprint(key *rsa.PublicKey) string {
+	canonical := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+		base64URLEncode(big.NewInt(int64(key.E)).Bytes()), base64URLEncode(key.N.Bytes()))
+	digest := sha256.Sum256([]byte(canonical))
+	return base64URLEncode(digest[:])
+}
+
+func base64URLEncode(contents []byte) string {
+	return base64.RawURLEncoding.EncodeToString(contents)
+}
+
+func base64URLDecode(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	web "github.com/blendlabs/go-web"
+)
+
+const (
+	// jwtDefaultCookie is the cookie `/jwt` reads tokens from when none is configured.
+	jwtDefaultCookie = "access_token"
+
+	jwtSourceAuthorization = "authorization"
+	jwtSourceCookie        = "cookie"
+	jwtSourceBody          = "body"
+)
+
+// jwtProblem is a reason a token is not valid.
+type jwtProblem struct {
+	Claim   string      `json:"claim"`
+	Problem string      `json:"problem"`
+	Detail  string      `json:"detail"`
+	Value   interface{} `json:"value,omitempty"`
+}
+
+// jwtSignatureReport is the outcome of verifying a token signature.
+type jwtSignatureReport struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id,omitempty"`
+	KeySource string `json:"key_source,omitempty"`
+	Verified  bool   `json:"verified"`
+	Error     string `json:"error,omitempty"`
+}
+
+// jwtReport is what `/jwt` knows about a token.
+type jwtReport struct {
+	Valid     bool                   `json:"valid"`
+	Source    string                 `json:"source,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	Header    map[string]interface{} `json:"header,omitempty"`
+	Claims    map[string]interface{} `json:"claims,omitempty"`
+	Times     map[string]time.Time   `json:"times,omitempty"`
+	Signature *jwtSignatureReport    `json:"signature,omitempty"`
+	Problems  []jwtProblem           `json:"problems"`
+}
+
+// newJWTInspector returns a new jwt inspector; `trusted` optionally supplies additional verification keys (i.e. the mock oidc provider's).
+func newJWTInspector(cfg jwtConfig, trusted func() jwkSet) *jwtInspector {
+	if len(cfg.Cookie) == 0 {
+		cfg.Cookie = jwtDefaultCookie
+	}
+	return &jwtInspector{config: cfg, trusted: trusted}
+}
+
+// jwtInspector decodes and verifies the tokens sent to `/jwt`.
+type jwtInspector struct {
+	config  jwtConfig
+	trusted func() jwkSet
+}
+
+// Action decodes the request token and reports its header, claims, signature and any claim problems.
+// It responds 200 for a valid token, 401 for an invalid one and 400 if there is no parseable token.
+func (ji *jwtInspector) Action(r *web.Ctx) web.Result {
+	raw, source, err := ji.token(r)
+	if err != nil {
+		return &web.JSONResult{StatusCode: http.StatusBadRequest, Response: jwtReport{Error: err.Error(), Problems: []jwtProblem{}}}
+	}
+	token, err := parseJWT(raw)
+	if err != nil {
+		return &web.JSONResult{StatusCode: http.StatusBadRequest, Response: jwtReport{Source: source, Error: err.Error(), Problems: []jwtProblem{}}}
+	}
+
+	audience := ji.config.Audience
+	if value := r.Request.URL.Query().Get("aud"); len(value) > 0 {
+		audience = value
+	}
+	report := jwtReport{
+		Source:    source,
+		Header:    token.HeaderFields,
+		Claims:    token.Claims,
+		Times:     map[string]time.Time{},
+		Signature: ji.verify(token),
+		Problems:  ji.problems(token, audience, time.Now().UTC()),
+	}
+	for _, name := range []string{"exp", "nbf", "iat"} {
+		if value, ok := token.claimTime(name); ok {
+			report.Times[name] = value
+		}
+	}
+	report.Valid = report.Signature.Verified && len(report.Problems) == 0
+	if !report.Valid {
+		return &web.JSONResult{StatusCode: http.StatusUnauthorized, Response: report}
+	}
+	return &web.JSONResult{StatusCode: http.StatusOK, Response: report}
+}
+
+// token returns the raw token and where it came from; the `Authorization` header wins over the cookie, which wins over the body.
+// The body is either the bare token, a `token` form field or a json object with a `token` field.
+func (ji *jwtInspector) token(r *web.Ctx) (string, string, error) {
+	if scheme, credentials := authorization(r); strings.EqualFold(scheme, "Bearer") && len(credentials) > 0 {
+		return credentials, jwtSourceAuthorization, nil
+	}
+	cookieName := ji.config.Cookie
+	if value := r.Request.URL.Query().Get("cookie"); len(value) > 0 {
+		cookieName = value
+	}
+	if cookie, err := r.Request.Cookie(cookieName); err == nil && len(cookie.Value) > 0 {
+		return cookie.Value, jwtSourceCookie, nil
+	}
+
+	body, err := r.PostBody()
+	if err != nil {
+		return "", "", err
+	}
+	body = []byte(strings.TrimSpace(string(body)))
+	if len(body) == 0 {
+		return "", "", fmt.Errorf("no token; send a bearer `%s` header, a `%s` cookie or the token as the body", headerAuthorization, cookieName)
+	}
+	if body[0] == '{' {
+		var object struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(body, &object); err != nil || len(object.Token) == 0 {
+			return "", "", fmt.Errorf("json body must have a `token` field")
+		}
+		return object.Token, jwtSourceBody, nil
+	}
+	if form, err := url.ParseQuery(string(body)); err == nil && len(form.Get("token")) > 0 {
+		return form.Get("token"), jwtSourceBody, nil
+	}
+	return string(body), jwtSourceBody, nil
+}
+
+// verify checks the token signature against the configured secret or keys.
+func (ji *jwtInspector) verify(token *jwtToken) *jwtSignatureReport {
+	report := &jwtSignatureReport{Algorithm: token.Header.Algorithm, KeyID: token.Header.KeyID}
+	switch token.Header.Algorithm {
+	case "HS256":
+		if len(ji.config.HS256Secret) == 0 {
+			report.Error = "no hs256 secret is configured"
+			return report
+		}
+		report.KeySource = "hs256_secret"
+		if err := token.verifyHS256([]byte(ji.config.HS256Secret)); err != nil {
+			report.Error = err.Error()
+			return report
+		}
+		report.Verified = true
+		return report
+	case "RS256", "ES256":
+	case "", "none":
+		report.Error = "unsigned tokens are never accepted"
+		return report
+	default:
+		report.Error = fmt.Sprintf("unsupported algorithm `%s`; expected HS256, RS256 or ES256", token.Header.Algorithm)
+		return report
+	}
+
+	keys, err := ji.keys()
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	var lastErr error
+	for _, candidate := range keys {
+		if len(token.Header.KeyID) > 0 && candidate.key.KeyID != token.Header.KeyID {
+			continue
+		}
+		publicKey, err := candidate.key.publicKey()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch typed := publicKey.(type) {
+		case *rsa.PublicKey:
+			if token.Header.Algorithm != "RS256" {
+				continue
+			}
+			err = token.verifyRS256(typed)
+		case *ecdsa.PublicKey:
+			if token.Header.Algorithm != "ES256" {
+				continue
+			}
+			err = token.verifyES256(typed)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		report.KeyID = candidate.key.KeyID
+		report.KeySource = candidate.source
+		report.Verified = true
+		return report
+	}
+	if lastErr != nil {
+		report.Error = lastErr.Error()
+	} else if len(token.Header.KeyID) > 0 {
+		report.Error = fmt.Sprintf("no %s key with id `%s`", token.Header.Algorithm, token.Header.KeyID)
+	} else {
+		report.Error = fmt.Sprintf("no %s keys", token.Header.Algorithm)
+	}
+	return report
+}
+
+// jwtCandidateKey is a verification key and where it came from.
+type jwtCandidateKey struct {
+	key    jwk
+	source string
+}
+
+// keys returns the configured jwks file keys (re-read so edits apply immediately) and any trusted keys.
+func (ji *jwtInspector) keys() ([]jwtCandidateKey, error) {
+	var keys []jwtCandidateKey
+	if len(ji.config.JWKSPath) > 0 {
+		contents, err := ioutil.ReadFile(ji.config.JWKSPath)
+		if err != nil {
+			return nil, err
+		}
+		var set jwkSet
+		if err := json.Unmarshal(contents, &set); err != nil {
+			return nil, fmt.Errorf("malformed jwks file: %v", err)
+		}
+		for _, key := range set.Keys {
+			keys = append(keys, jwtCandidateKey{key: key, source: "jwks_path"})
+		}
+	}
+	if ji.trusted != nil {
+		for _, key := range ji.trusted().Keys {
+			keys = append(keys, jwtCandidateKey{key: key, source: "oidc"})
+		}
+	}
+	return keys, nil
+}
+
+// problems returns the time, issuer and audience claim problems with the token as of `now`.
+func (ji *jwtInspector) problems(token *jwtToken, audience string, now time.Time) []jwtProblem {
+	problems := []jwtProblem{}
+	leeway := ji.config.Leeway
+
+	if _, present := token.Claims["exp"]; present {
+		if expires, ok := token.claimTime("exp"); !ok {
+			problems = append(problems, jwtProblem{Claim: "exp", Problem: "malformed", Detail: "exp is not a NumericDate", Value: token.Claims["exp"]})
+		} else if !now.Before(expires.Add(leeway)) {
+			problems = append(problems, jwtProblem{Claim: "exp", Problem: "expired", Detail: fmt.Sprintf("expired %v ago", jwtSeconds(now.Sub(expires))), Value: expires})
+		}
+	}
+	if _, present := token.Claims["nbf"]; present {
+		if notBefore, ok := token.claimTime("nbf"); !ok {
+			problems = append(problems, jwtProblem{Claim: "nbf", Problem: "malformed", Detail: "nbf is not a NumericDate", Value: token.Claims["nbf"]})
+		} else if now.Add(leeway).Before(notBefore) {
+			problems = append(problems, jwtProblem{Claim: "nbf", Problem: "not_yet_valid", Detail: fmt.Sprintf("valid in %v", jwtSeconds(notBefore.Sub(now))), Value: notBefore})
+		}
+	}
+	if issuedAt, ok := token.claimTime("iat"); ok && now.Add(leeway).Before(issuedAt) {
+		problems = append(problems, jwtProblem{Claim: "iat", Problem: "issued_in_future", Detail: fmt.Sprintf("issued %v from now", jwtSeconds(issuedAt.Sub(now))), Value: issuedAt})
+	}
+	if len(ji.config.Issuer) > 0 {
+		if issuer, _ := token.Claims["iss"].(string); issuer != ji.config.Issuer {
+			problems = append(problems, jwtProblem{Claim: "iss", Problem: "issuer_mismatch", Detail: fmt.Sprintf("expected `%s`", ji.config.Issuer), Value: token.Claims["iss"]})
+		}
+	}
+	if len(audience) > 0 && !jwtHasAudience(token.Claims["aud"], audience) {
+		problems = append(problems, jwtProblem{Claim: "aud", Problem: "audience_mismatch", Detail: fmt.Sprintf("expected `%s`", audience), Value: token.Claims["aud"]})
+	}
+	return problems
+}
+
+// jwtSeconds truncates a duration to whole seconds for display.
+func jwtSeconds(duration time.Duration) time.Duration {
+	return duration - duration%time.Second
+}
+
+// jwtHasAudience returns if an `aud` claim, a string or an array of strings, contains an audience.
+func jwtHasAudience(claim interface{}, audience string) bool {
+	switch typed := claim.(type) {
+	case string:
+		return typed == audience
+	case []interface{}:
+		for _, value := range typed {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"syscall"
 	"time"
 
 	logger "github.com/blendlabs/go-logger"
@@ -18,26 +22,129 @@ func main() {
 
 	appStart := time.Now()
 
-	contents, err := ioutil.ReadFile(env.Env().String("CONFIG_PATH", "/var/secrets/config.yml"))
+	// a missing config file means the defaults, but one that can't be read or parsed is fatal.
+	configPath := env.Env().String("CONFIG_PATH", "/var/secrets/config.yml")
+	contents, err := ioutil.ReadFile(configPath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v", err)
+		if !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	cfg, err := parseConfig(contents)
+	if err != nil {
+		log.Fatalf("invalid config file %s: %v", configPath, err)
 	}
 
+	redactor := newRedactor(cfg.Redaction)
+	agent.Writer().SetRedactor(redactor)
+
 	app := web.New()
 	app.SetLogger(agent)
+	accessLog, err := logger.NewAccessLogWriterFromEnvironment()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if accessLog != nil {
+		accessLog.SetRedactor(redactor)
+		// listeners only fire for enabled events, so the access log enables request events even if `LOG_EVENTS` doesn't.
+		agent.EnableEvent(web.EventWebRequest)
+		agent.AddEventListener(web.EventWebRequest, web.NewAccessLogListener(accessLog))
+	}
+	errorAggregator := web.NewErrorAggregator()
+	errorAggregator.SetRedactor(redactor)
+	// listeners only fire for enabled events, so errors are enabled for the aggregator even if `LOG_EVENTS` doesn't.
+	for _, event := range []logger.EventFlag{logger.EventError, logger.EventFatalError} {
+		agent.EnableEvent(event)
+		agent.AddEventListener(event, errorAggregator.Listener())
+	}
+	app.SetRequestIDHeader(cfg.RequestID.HeaderOrDefault())
+	tracer, err := newTracer(cfg.Tracing)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.SetTracer(tracer)
+	requestLogPolicies, err := cfg.RequestLog.Policies()
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.SetRequestLogPolicies(requestLogPolicies)
+	var admin web.Middleware
+	if token := cfg.Admin.TokenOrDefault(); len(token) > 0 {
+		admin = requireAdminToken(token)
+	} else {
+		agent.Warningf("no admin token is configured (`admin.token` or ADMIN_TOKEN); the /_admin routes are not served")
+	}
+	var persistence web.Persistence
+	if len(cfg.Persistence.Path) > 0 {
+		filePersistence, err := web.NewFilePersistence(cfg.Persistence.Path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if cfg.Persistence.SnapshotInterval > 0 {
+			filePersistence.SetSnapshotInterval(cfg.Persistence.SnapshotInterval)
+		}
+		filePersistence.Start()
+		persistence = filePersistence
+	}
+	var trusted func() jwkSet
+	if cfg.OIDC.Enabled {
+		provider, err := newOIDCProvider(cfg.OIDC, persistence)
+		if err != nil {
+			log.Fatal(err)
+		}
+		provider.Register(app, admin)
+		trusted = provider.keySet
+	}
+	sessions, err := newSessions(cfg.Session, app.Auth(), persistence)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessions.Register(app)
+	webhooks, err := newWebhooks(cfg.Webhooks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhooks.Register(app)
+	callbacks, err := newCallbacks(cfg.RequestID.HeaderOrDefault(), redactor, persistence)
+	if err != nil {
+		log.Fatal(err)
+	}
+	callbacks.Register(app)
+	registerAdmin(app, admin, agent, errorAggregator)
+	inspector := newJWTInspector(cfg.JWT, trusted)
+	app.GET("/jwt", inspector.Action)
+	app.POST("/jwt", inspector.Action)
 	app.GET("/", func(r *web.Ctx) web.Result {
 		return r.Text().Result("echo")
 	})
 	app.GET("/headers", func(r *web.Ctx) web.Result {
-		contents, err := json.Marshal(r.Request.Header)
-		if err != nil {
-			return r.View().InternalError(err)
-		}
-		return r.Text().Result(string(contents))
+		return r.Negotiated().Result(headers(redactor.Header(r.Request.Header)))
 	})
+	app.GET("/trace", trace)
 	app.GET("/env", func(r *web.Ctx) web.Result {
-		return r.JSON().Result(env.Env().Vars())
+		vars := envVars(env.Env().Vars())
+		sort.Strings(vars)
+		return r.Negotiated().Result(vars)
 	})
+	app.GET("/encoding", encoding)
+	app.POST("/encoding", encoding)
+	app.GET("/cookies", cookies)
+	app.GET("/cookies/set", cookiesSet)
+	app.GET("/cookies/delete", cookiesDelete)
+	handleRedirect(app, "/redirect/:n", redirect)
+	handleRedirect(app, "/absolute-redirect/:n", absoluteRedirect)
+	handleRedirect(app, "/relative-redirect/:n", relativeRedirect)
+	handleRedirect(app, "/redirect-to", redirectTo)
+	handleRedirect(app, "/redirected", redirected)
+	digest := newDigestAuth()
+	app.GET("/auth/basic/:user/:pass", authBasic)
+	app.POST("/auth/basic/:user/:pass", authBasic)
+	app.GET("/auth/bearer", authBearer)
+	app.POST("/auth/bearer", authBearer)
+	app.GET("/auth/digest/:qop/:user/:pass", digest.Action)
+	app.POST("/auth/digest/:qop/:user/:pass", digest.Action)
 	app.GET("/status", func(r *web.Ctx) web.Result {
 		if time.Since(appStart) > 12*time.Second {
 			return r.Text().Result("OK!")
@@ -45,8 +152,16 @@ func main() {
 		return r.Text().BadRequest("not ready")
 	})
 	app.GET("/config", func(r *web.Ctx) web.Result {
-		r.Response.Header().Set("Content-Type", "application/yaml") // but is it really?
-		return r.Raw(contents)
+		negotiated := r.Negotiated()
+		redacted, err := redactYAML(redactor, contents)
+		if err != nil {
+			return negotiated.InternalError(err)
+		}
+		// yaml is the (redacted) file itself, comments and all, where it can be, rather than the re-encoded document.
+		if format, ok := negotiated.Format(); ok && format == web.FormatYAML {
+			return r.RawWithContentType(web.ContentTypeYAML, redacted)
+		}
+		return negotiated.Result(newConfigDocument(redacted))
 	})
 	app.GET("/long", func(r *web.Ctx) web.Result {
 		ticker := time.NewTicker(500 * time.Millisecond)
@@ -59,8 +174,6 @@ func main() {
 				}
 			}
 		}
-
-		return nil
 	})
 	app.GET("/echo/*filepath", func(r *web.Ctx) web.Result {
 		body := r.Request.URL.Path
@@ -80,5 +193,54 @@ func main() {
 		return r.RawWithContentType(web.ContentTypeText, body)
 	})
 
-	log.Fatal(app.Start())
+	server := app.Server()
+	stopping := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		close(stopping)
+		shutdown(server, callbacks, sessions, tracer, persistence, agent)
+		close(stopped)
+	}()
+	if err := app.StartWithServer(server); err != nil {
+		select {
+		case <-stopping:
+		default:
+			log.Fatal(err)
+		}
+	}
+	<-stopped
+}
+
+// shutdownTimeout is how long in-flight requests, pending callbacks, queued spans and queued log events get to finish on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+// shutdown stops the server, then drains the callback queue, saves the sessions and drains the span exporter and the log
+// before closing persistence.
+func shutdown(server *http.Server, callbacks *callbacks, sessions *sessions, tracer *web.Tracer, persistence web.Persistence, agent *logger.Agent) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		agent.Sync().Errorf("server shutdown: %v", err)
+	}
+	if err := callbacks.Shutdown(ctx); err != nil {
+		agent.Sync().Errorf("callbacks shutdown: %v", err)
+	}
+	if err := sessions.Close(); err != nil {
+		agent.Sync().Errorf("sessions close: %v", err)
+	}
+	if err := tracer.Close(ctx); err != nil {
+		agent.Sync().Errorf("tracer close: %v", err)
+	}
+	if err := agent.DrainContext(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "log drain: %v\n", err)
+	}
+	if persistence != nil {
+		if err := persistence.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "persistence close: %v\n", err)
+		}
+	}
 }
@@ -0,0 +1,775 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	web "github.com/blendlabs/go-web"
+)
+
+const (
+	oidcKeyBits              = 2048
+	oidcAuthorizationCodeTTL = time.Minute
+
+	oidcDefaultSubject         = "echo-user"
+	oidcDefaultAccessTokenTTL  = time.Hour
+	oidcDefaultIDTokenTTL      = time.Hour
+	oidcDefaultRefreshTokenTTL = 24 * time.Hour
+
+	oidcScopeOpenID = "openid"
+
+	// oidcCollection is the persistence collection the signing keys are kept in, under oidcKeysKey;
+	// oidcCodesCollection and oidcRefreshTokensCollection keep the grants, by code and refresh token.
+	oidcCollection              = "oidc"
+	oidcKeysKey                 = "keys"
+	oidcCodesCollection         = "oidc_codes"
+	oidcRefreshTokensCollection = "oidc_refresh_tokens"
+)
+
+// oidcRegisteredClaims are set by the provider and can't be overridden by configured claims.
+var oidcRegisteredClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "iat": true, "nbf": true, "jti": true,
+	"auth_time": true, "nonce": true, "azp": true, "at_hash": true, "scope": true, "client_id": true,
+}
+
+// newOIDCProvider returns a new mock OpenID Connect provider with a fresh signing key.
+// If a persistence is given, the signing keys and unexpired grants are also kept in it and loaded from it, so tokens,
+// codes and refresh tokens stay valid across restarts.
+func newOIDCProvider(cfg oidcConfig, persistence web.Persistence) (*oidcProvider, error) {
+	if len(cfg.Subject) == 0 {
+		cfg.Subject = oidcDefaultSubject
+	}
+	if cfg.AccessTokenTTL <= 0 {
+		cfg.AccessTokenTTL = oidcDefaultAccessTokenTTL
+	}
+	if cfg.IDTokenTTL <= 0 {
+		cfg.IDTokenTTL = oidcDefaultIDTokenTTL
+	}
+	if cfg.RefreshTokenTTL <= 0 {
+		cfg.RefreshTokenTTL = oidcDefaultRefreshTokenTTL
+	}
+	provider := &oidcProvider{
+		config:        cfg,
+		persistence:   persistence,
+		codes:         map[string]*oidcGrant{},
+		refreshTokens: map[string]*oidcGrant{},
+	}
+	if persistence != nil {
+		if err := provider.load(); err != nil {
+			return nil, err
+		}
+	}
+	if len(provider.keys) == 0 {
+		if _, err := provider.RotateKeys(false); err != nil {
+			return nil, err
+		}
+	}
+	return provider, nil
+}
+
+// oidcProvider is a mock OpenID Connect provider (authorization code with PKCE, client credentials and refresh token flows).
+// Authorization is granted without any user interaction; the subject is the configured one or the `login_hint`.
+type oidcProvider struct {
+	config      oidcConfig
+	persistence web.Persistence
+
+	keysLock sync.Mutex
+	keys     []*oidcSigningKey
+
+	grantsLock    sync.Mutex
+	codes         map[string]*oidcGrant
+	refreshTokens map[string]*oidcGrant
+}
+
+// oidcSigningKey is an RS256 signing key; the first key in the provider's list signs, the rest only verify.
+type oidcSigningKey struct {
+	ID      string
+	Key     *rsa.PrivateKey
+	Created time.Time
+}
+
+// persistedOIDCSigningKey is the persisted form of a signing key.
+type persistedOIDCSigningKey struct {
+	ID      string    `json:"kid"`
+	Key     []byte    `json:"key"` // PKCS #1, ASN.1 DER.
+	Created time.Time `json:"created"`
+}
+
+// oidcGrant is the state behind an authorization code or refresh token.
+type oidcGrant struct {
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Subject             string
+	ClientCredentials   bool
+	AuthTime            time.Time
+	Expires             time.Time
+}
+
+// oidcError is an OAuth2 error response (RFC 6749 section 5.2).
+type oidcError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// oidcKeyInfo describes a signing key for the admin endpoints.
+type oidcKeyInfo struct {
+	KeyID   string    `json:"kid"`
+	Active  bool      `json:"active"`
+	Created time.Time `json:"created"`
+}
+
+// Register adds the provider's routes to an app; the key admin routes are only added with the admin middleware.
+func (op *oidcProvider) Register(app *web.App, admin web.Middleware) {
+	app.GET("/.well-known/openid-configuration", op.discovery)
+	app.GET("/.well-known/jwks.json", op.jwks)
+	app.GET("/oauth2/authorize", op.authorize)
+	app.POST("/oauth2/authorize", op.authorize)
+	app.POST("/oauth2/token", op.token)
+	app.GET("/oauth2/userinfo", op.userinfo)
+	app.POST("/oauth2/userinfo", op.userinfo)
+	if admin != nil {
+		app.GET("/_admin/oidc/keys", op.adminKeys, admin)
+		app.POST("/_admin/oidc/keys/rotate", op.adminRotateKeys, admin)
+	}
+}
+
+// RotateKeys generates a new active signing key. The previous key is kept (for verification only)
+// unless `dropPrevious` is set; older keys are always dropped.
+func (op *oidcProvider) RotateKeys(dropPrevious bool) (*oidcSigningKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, oidcKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	signingKey := &oidcSigningKey{
+		ID:      rsaThumbprint(&key.PublicKey),
+		Key:     key,
+		Created: time.Now().UTC(),
+	}
+
+	op.keysLock.Lock()
+	defer op.keysLock.Unlock()
+	keys := []*oidcSigningKey{signingKey}
+	if !dropPrevious && len(op.keys) > 0 {
+		keys = append(keys, op.keys[0])
+	}
+	if err := op.persistKeys(keys); err != nil {
+		return nil, err
+	}
+	op.keys = keys
+	return signingKey, nil
+}
+
+// persistKeys writes the signing keys, active key first, if there is a persistence.
+func (op *oidcProvider) persistKeys(keys []*oidcSigningKey) error {
+	if op.persistence == nil {
+		return nil
+	}
+	persisted := make([]persistedOIDCSigningKey, 0, len(keys))
+	for _, key := range keys {
+		persisted = append(persisted, persistedOIDCSigningKey{ID: key.ID, Key: x509.MarshalPKCS1PrivateKey(key.Key), Created: key.Created})
+	}
+	contents, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+	return op.persistence.Put(oidcCollection, oidcKeysKey, contents)
+}
+
+// load reads the persisted signing keys and grants; expired grants are deleted rather than loaded.
+func (op *oidcProvider) load() error {
+	contents, hasKeys, err := op.persistence.Get(oidcCollection, oidcKeysKey)
+	if err != nil {
+		return err
+	}
+	if hasKeys {
+		var persisted []persistedOIDCSigningKey
+		if err := json.Unmarshal(contents, &persisted); err != nil {
+			return fmt.Errorf("invalid persisted oidc keys: %v", err)
+		}
+		for _, key := range persisted {
+			privateKey, err := x509.ParsePKCS1PrivateKey(key.Key)
+			if err != nil {
+				return fmt.Errorf("invalid persisted oidc key `%s`: %v", key.ID, err)
+			}
+			op.keys = append(op.keys, &oidcSigningKey{ID: key.ID, Key: privateKey, Created: key.Created})
+		}
+	}
+
+	now := time.Now().UTC()
+	for collection, grants := range map[string]map[string]*oidcGrant{oidcCodesCollection: op.codes, oidcRefreshTokensCollection: op.refreshTokens} {
+		var expired []string
+		err := op.persistence.Each(collection, func(key string, value []byte) error {
+			var grant oidcGrant
+			if err := json.Unmarshal(value, &grant); err != nil {
+				return fmt.Errorf("invalid persisted oidc grant: %v", err)
+			}
+			if now.After(grant.Expires) {
+				expired = append(expired, key)
+			} else {
+				grants[key] = &grant
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := op.persistence.Delete(collection, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (op *oidcProvider) signingKey() *oidcSigningKey {
+	op.keysLock.Lock()
+	defer op.keysLock.Unlock()
+	return op.keys[0]
+}
+
+func (op *oidcProvider) verificationKey(keyID string) *oidcSigningKey {
+	op.keysLock.Lock()
+	defer op.keysLock.Unlock()
+	for _, key := range op.keys {
+		if key.ID == keyID {
+			return key
+		}
+	}
+	return nil
+}
+
+func (op *oidcProvider) keySet() jwkSet {
+	op.keysLock.Lock()
+	defer op.keysLock.Unlock()
+	set := jwkSet{Keys: []jwk{}}
+	for _, key := range op.keys {
+		set.Keys = append(set.Keys, newRSAJWK(key.ID, &key.Key.PublicKey))
+	}
+	return set
+}
+
+func (op *oidcProvider) issuer(r *web.Ctx) string {
+	if len(op.config.Issuer) > 0 {
+		return strings.TrimRight(op.config.Issuer, "/")
+	}
+	return requestBaseURL(r)
+}
+
+// --------------------------------------------------------------------------------
+// endpoints
+// --------------------------------------------------------------------------------
+
+func (op *oidcProvider) discovery(r *web.Ctx) web.Result {
+	issuer := op.issuer(r)
+	claims := []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "azp", "at_hash"}
+	var configured []string
+	for name := range op.config.Claims {
+		if !oidcRegisteredClaims[name] {
+			configured = append(configured, name)
+		}
+	}
+	sort.Strings(configured)
+
+	return r.JSON().Result(map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth2/authorize",
+		"token_endpoint":                        issuer + "/oauth2/token",
+		"userinfo_endpoint":                     issuer + "/oauth2/userinfo",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"response_modes_supported":              []string{"query"},
+		"grant_types_supported":                 []string{"authorization_code", "client_credentials", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{oidcScopeOpenID, "profile", "email", "offline_access"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256", "plain"},
+		"claims_supported":                      append(claims, configured...),
+	})
+}
+
+func (op *oidcProvider) jwks(r *web.Ctx) web.Result {
+	return r.JSON().Result(op.keySet())
+}
+
+// authorize is the authorization endpoint; it immediately redirects back with a code.
+func (op *oidcProvider) authorize(r *web.Ctx) web.Result {
+	if err := r.Request.ParseForm(); err != nil {
+		return r.Negotiated().BadRequest(err.Error())
+	}
+	form := r.Request.Form
+
+	// errors about the client or redirect uri can't be redirected (RFC 6749 section 4.1.2.1).
+	client, clientErr := op.lookupClient(form.Get("client_id"))
+	if clientErr != nil {
+		return r.Negotiated().BadRequest(clientErr.ErrorDescription)
+	}
+	redirectURI, err := op.redirectURI(client, form.Get("redirect_uri"))
+	if err != nil {
+		return r.Negotiated().BadRequest(err.Error())
+	}
+
+	state := form.Get("state")
+	if responseType := form.Get("response_type"); responseType != "code" {
+		return op.redirectError(r, redirectURI, state, "unsupported_response_type", "only the `code` response type is supported")
+	}
+	challenge := form.Get("code_challenge")
+	challengeMethod := form.Get("code_challenge_method")
+	if len(challenge) > 0 && len(challengeMethod) == 0 {
+		challengeMethod = "plain"
+	}
+	if len(challenge) > 0 && challengeMethod != "S256" && challengeMethod != "plain" {
+		return op.redirectError(r, redirectURI, state, "invalid_request", "code_challenge_method must be S256 or plain")
+	}
+	if len(challenge) == 0 && client != nil && len(client.Secret) == 0 {
+		return op.redirectError(r, redirectURI, state, "invalid_request", "public clients must use PKCE")
+	}
+	scope := form.Get("scope")
+	if len(scope) == 0 {
+		scope = oidcScopeOpenID
+	}
+	subject := form.Get("login_hint")
+	if len(subject) == 0 {
+		subject = op.config.Subject
+	}
+
+	code := randomToken()
+	err = op.storeGrant(op.codes, oidcCodesCollection, code, &oidcGrant{
+		ClientID:            form.Get("client_id"),
+		RedirectURI:         form.Get("redirect_uri"),
+		Scope:               scope,
+		Nonce:               form.Get("nonce"),
+		CodeChallenge:       challenge,
+		CodeChallengeMethod: challengeMethod,
+		Subject:             subject,
+		AuthTime:            time.Now().UTC(),
+		Expires:             time.Now().UTC().Add(oidcAuthorizationCodeTTL),
+	})
+	if err != nil {
+		return r.Negotiated().InternalError(err)
+	}
+
+	parameters := url.Values{"code": []string{code}}
+	if len(state) > 0 {
+		parameters.Set("state", state)
+	}
+	return r.RedirectWithStatusf(http.StatusFound, "%s", appendQuery(redirectURI, parameters))
+}
+
+// token is the token endpoint.
+func (op *oidcProvider) token(r *web.Ctx) web.Result {
+	r.Response.Header().Set(web.HeaderCacheControl, "no-store")
+	r.Response.Header().Set("Pragma", "no-cache")
+	if err := r.Request.ParseForm(); err != nil {
+		return op.tokenError(r, http.StatusBadRequest, "invalid_request", err.Error())
+	}
+	form := r.Request.PostForm
+
+	clientID, client, clientErr := op.authenticateClient(r)
+	if clientErr != nil {
+		if len(r.Request.Header.Get(headerAuthorization)) > 0 {
+			r.Response.Header().Set(headerWWWAuthenticate, fmt.Sprintf(`Basic realm="%s"`, authRealm))
+		}
+		return op.tokenError(r, http.StatusUnauthorized, clientErr.Error, clientErr.ErrorDescription)
+	}
+
+	switch form.Get("grant_type") {
+	case "authorization_code":
+		grant, err := op.takeGrant(op.codes, oidcCodesCollection, form.Get("code"))
+		if err != nil {
+			return op.tokenError(r, http.StatusInternalServerError, "server_error", err.Error())
+		}
+		if grant == nil {
+			return op.tokenError(r, http.StatusBadRequest, "invalid_grant", "unknown, used or expired authorization code")
+		}
+		if grant.ClientID != clientID || grant.RedirectURI != form.Get("redirect_uri") {
+			return op.tokenError(r, http.StatusBadRequest, "invalid_grant", "client_id or redirect_uri does not match the authorization request")
+		}
+		if !verifyCodeChallenge(grant.CodeChallenge, grant.CodeChallengeMethod, form.Get("code_verifier")) {
+			return op.tokenError(r, http.StatusBadRequest, "invalid_grant", "code_verifier does not match the code_challenge")
+		}
+		return op.issueTokens(r, clientID, grant, true)
+
+	case "refresh_token":
+		grant, err := op.takeGrant(op.refreshTokens, oidcRefreshTokensCollection, form.Get("refresh_token"))
+		if err != nil {
+			return op.tokenError(r, http.StatusInternalServerError, "server_error", err.Error())
+		}
+		if grant == nil {
+			return op.tokenError(r, http.StatusBadRequest, "invalid_grant", "unknown, used or expired refresh token")
+		}
+		if grant.ClientID != clientID {
+			return op.tokenError(r, http.StatusBadRequest, "invalid_grant", "refresh token was issued to another client")
+		}
+		if scope := form.Get("scope"); len(scope) > 0 {
+			if !scopeContains(grant.Scope, scope) {
+				return op.tokenError(r, http.StatusBadRequest, "invalid_scope", "requested scope exceeds the original grant")
+			}
+			narrowed := *grant
+			narrowed.Scope = scope
+			grant = &narrowed
+		}
+		return op.issueTokens(r, clientID, grant, true)
+
+	case "client_credentials":
+		if client != nil && len(client.Secret) == 0 {
+			return op.tokenError(r, http.StatusBadRequest, "unauthorized_client", "public clients can't use client credentials")
+		}
+		grant := &oidcGrant{
+			ClientID:          clientID,
+			Scope:             form.Get("scope"),
+			Subject:           clientID,
+			ClientCredentials: true,
+			AuthTime:          time.Now().UTC(),
+		}
+		return op.issueTokens(r, clientID, grant, false)
+	}
+	return op.tokenError(r, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code, refresh_token or client_credentials")
+}
+
+// userinfo returns the subject and non-registered claims of a valid access token.
+func (op *oidcProvider) userinfo(r *web.Ctx) web.Result {
+	wwwAuthenticate := fmt.Sprintf(`Bearer realm="%s"`, authRealm)
+	scheme, credentials := authorization(r)
+	if !strings.EqualFold(scheme, "Bearer") || len(credentials) == 0 {
+		r.Response.Header().Set(headerWWWAuthenticate, wwwAuthenticate)
+		return op.tokenError(r, http.StatusUnauthorized, "invalid_request", "a bearer access token is required")
+	}
+	claims, err := op.verifyAccessToken(r, credentials)
+	if err != nil {
+		r.Response.Header().Set(headerWWWAuthenticate, wwwAuthenticate+`, error="invalid_token"`)
+		return op.tokenError(r, http.StatusUnauthorized, "invalid_token", err.Error())
+	}
+	info := map[string]interface{}{"sub": claims["sub"]}
+	for name, value := range claims {
+		if !oidcRegisteredClaims[name] {
+			info[name] = value
+		}
+	}
+	return r.JSON().Result(info)
+}
+
+func (op *oidcProvider) adminKeys(r *web.Ctx) web.Result {
+	op.keysLock.Lock()
+	defer op.keysLock.Unlock()
+	infos := []oidcKeyInfo{}
+	for index, key := range op.keys {
+		infos = append(infos, oidcKeyInfo{KeyID: key.ID, Active: index == 0, Created: key.Created})
+	}
+	return r.JSON().Result(infos)
+}
+
+// adminRotateKeys rotates the signing key; `?drop_previous=true` also stops publishing the previous key,
+// invalidating every token signed with it.
+func (op *oidcProvider) adminRotateKeys(r *web.Ctx) web.Result {
+	dropPrevious := r.Request.URL.Query().Get("drop_previous") == "true"
+	if _, err := op.RotateKeys(dropPrevious); err != nil {
+		return r.JSON().InternalError(err)
+	}
+	return op.adminKeys(r)
+}
+
+// --------------------------------------------------------------------------------
+// helpers
+// --------------------------------------------------------------------------------
+
+// lookupClient returns the registered client for an id; with no clients configured any id is accepted (and nil returned).
+func (op *oidcProvider) lookupClient(clientID string) (*oidcClient, *oidcError) {
+	if len(clientID) == 0 {
+		return nil, &oidcError{Error: "invalid_client", ErrorDescription: "client_id is required"}
+	}
+	if len(op.config.Clients) == 0 {
+		return nil, nil
+	}
+	for index := range op.config.Clients {
+		if op.config.Clients[index].ID == clientID {
+			return &op.config.Clients[index], nil
+		}
+	}
+	return nil, &oidcError{Error: "invalid_client", ErrorDescription: fmt.Sprintf("unknown client `%s`", clientID)}
+}
+
+// authenticateClient reads client credentials from basic auth or the form (`client_secret_basic` / `client_secret_post`).
+func (op *oidcProvider) authenticateClient(r *web.Ctx) (string, *oidcClient, *oidcError) {
+	clientID, secret, hasBasic := r.Request.BasicAuth()
+	if hasBasic {
+		// the credentials are form encoded before being base64 encoded (RFC 6749 section 2.3.1).
+		if unescaped, err := url.QueryUnescape(clientID); err == nil {
+			clientID = unescaped
+		}
+		if unescaped, err := url.QueryUnescape(secret); err == nil {
+			secret = unescaped
+		}
+	} else {
+		clientID = r.Request.PostForm.Get("client_id")
+		secret = r.Request.PostForm.Get("client_secret")
+	}
+
+	client, clientErr := op.lookupClient(clientID)
+	if clientErr != nil {
+		return "", nil, clientErr
+	}
+	if client != nil && subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1 {
+		return "", nil, &oidcError{Error: "invalid_client", ErrorDescription: "invalid client credentials"}
+	}
+	return clientID, client, nil
+}
+
+// redirectURI validates a requested redirect uri against the client's registered ones.
+func (op *oidcProvider) redirectURI(client *oidcClient, requested string) (string, error) {
+	if client != nil && len(client.RedirectURIs) > 0 {
+		if len(requested) == 0 && len(client.RedirectURIs) == 1 {
+			return client.RedirectURIs[0], nil
+		}
+		for _, registered := range client.RedirectURIs {
+			if registered == requested {
+				return requested, nil
+			}
+		}
+		return "", fmt.Errorf("redirect_uri `%s` is not registered for client `%s`", requested, client.ID)
+	}
+	if len(requested) == 0 {
+		return "", fmt.Errorf("redirect_uri is required")
+	}
+	parsed, err := url.Parse(requested)
+	if err != nil || !parsed.IsAbs() {
+		return "", fmt.Errorf("redirect_uri must be an absolute uri")
+	}
+	return requested, nil
+}
+
+func (op *oidcProvider) redirectError(r *web.Ctx, redirectURI, state, code, description string) web.Result {
+	parameters := url.Values{"error": []string{code}, "error_description": []string{description}}
+	if len(state) > 0 {
+		parameters.Set("state", state)
+	}
+	return r.RedirectWithStatusf(http.StatusFound, "%s", appendQuery(redirectURI, parameters))
+}
+
+func (op *oidcProvider) tokenError(r *web.Ctx, statusCode int, code, description string) web.Result {
+	return &web.JSONResult{
+		StatusCode: statusCode,
+		Response:   oidcError{Error: code, ErrorDescription: description},
+	}
+}
+
+// issueTokens returns an access token, an id token (for the `openid` scope) and optionally a refresh token.
+func (op *oidcProvider) issueTokens(r *web.Ctx, clientID string, grant *oidcGrant, withRefreshToken bool) web.Result {
+	now := time.Now().UTC()
+	issuer := op.issuer(r)
+	key := op.signingKey()
+
+	audience := clientID
+	if len(op.config.Audience) > 0 {
+		audience = op.config.Audience
+	}
+	accessClaims := op.claims(!grant.ClientCredentials)
+	accessClaims["iss"] = issuer
+	accessClaims["sub"] = grant.Subject
+	accessClaims["aud"] = audience
+	accessClaims["iat"] = now.Unix()
+	accessClaims["nbf"] = now.Unix()
+	accessClaims["exp"] = now.Add(op.config.AccessTokenTTL).Unix()
+	accessClaims["jti"] = randomToken()
+	accessClaims["client_id"] = clientID
+	if len(grant.Scope) > 0 {
+		accessClaims["scope"] = grant.Scope
+	}
+	accessToken, err := signRS256(key.Key, key.ID, accessClaims)
+	if err != nil {
+		return r.JSON().InternalError(err)
+	}
+
+	response := map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(op.config.AccessTokenTTL.Seconds()),
+	}
+	if len(grant.Scope) > 0 {
+		response["scope"] = grant.Scope
+	}
+
+	if scopeContains(grant.Scope, oidcScopeOpenID) {
+		atHash := sha256.Sum256([]byte(accessToken))
+		idClaims := op.claims(!grant.ClientCredentials)
+		idClaims["iss"] = issuer
+		idClaims["sub"] = grant.Subject
+		idClaims["aud"] = clientID
+		idClaims["azp"] = clientID
+		idClaims["iat"] = now.Unix()
+		idClaims["exp"] = now.Add(op.config.IDTokenTTL).Unix()
+		idClaims["auth_time"] = grant.AuthTime.Unix()
+		idClaims["at_hash"] = base64URLEncode(atHash[:len(atHash)/2])
+		if len(grant.Nonce) > 0 {
+			idClaims["nonce"] = grant.Nonce
+		}
+		idToken, err := signRS256(key.Key, key.ID, idClaims)
+		if err != nil {
+			return r.JSON().InternalError(err)
+		}
+		response["id_token"] = idToken
+	}
+
+	if withRefreshToken {
+		refreshToken := randomToken()
+		refreshGrant := *grant
+		refreshGrant.Expires = now.Add(op.config.RefreshTokenTTL)
+		if err := op.storeGrant(op.refreshTokens, oidcRefreshTokensCollection, refreshToken, &refreshGrant); err != nil {
+			return r.JSON().InternalError(err)
+		}
+		response["refresh_token"] = refreshToken
+	}
+	return r.JSON().Result(response)
+}
+
+// claims returns a copy of the configured (user) claims if `include` is set, less any registered claim names.
+func (op *oidcProvider) claims(include bool) map[string]interface{} {
+	claims := map[string]interface{}{}
+	if !include {
+		return claims
+	}
+	for name, value := range op.config.Claims {
+		if !oidcRegisteredClaims[name] {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+// verifyAccessToken checks an access token was issued (and is still valid) by this provider.
+func (op *oidcProvider) verifyAccessToken(r *web.Ctx, raw string) (map[string]interface{}, error) {
+	token, err := parseJWT(raw)
+	if err != nil {
+		return nil, err
+	}
+	key := op.verificationKey(token.Header.KeyID)
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key `%s`", token.Header.KeyID)
+	}
+	if err := token.verifyRS256(&key.Key.PublicKey); err != nil {
+		return nil, err
+	}
+	if issuer, _ := token.Claims["iss"].(string); issuer != op.issuer(r) {
+		return nil, fmt.Errorf("unexpected issuer `%s`", issuer)
+	}
+	if expires, ok := token.claimTime("exp"); !ok || time.Now().UTC().After(expires) {
+		return nil, fmt.Errorf("token is expired")
+	}
+	return token.Claims, nil
+}
+
+// storeGrant adds a grant, dropping expired ones; grants are persisted in a given collection if there is a persistence.
+func (op *oidcProvider) storeGrant(grants map[string]*oidcGrant, collection, key string, grant *oidcGrant) error {
+	var contents []byte
+	if op.persistence != nil {
+		var err error
+		if contents, err = json.Marshal(grant); err != nil {
+			return err
+		}
+	}
+
+	op.grantsLock.Lock()
+	now := time.Now().UTC()
+	var expired []string
+	for existing, existingGrant := range grants {
+		if now.After(existingGrant.Expires) {
+			delete(grants, existing)
+			expired = append(expired, existing)
+		}
+	}
+	grants[key] = grant
+	op.grantsLock.Unlock()
+
+	if op.persistence == nil {
+		return nil
+	}
+	for _, existing := range expired {
+		if err := op.persistence.Delete(collection, existing); err != nil {
+			return err
+		}
+	}
+	return op.persistence.Put(collection, key, contents)
+}
+
+// takeGrant removes and returns an unexpired grant; codes and refresh tokens are single use.
+func (op *oidcProvider) takeGrant(grants map[string]*oidcGrant, collection, key string) (*oidcGrant, error) {
+	op.grantsLock.Lock()
+	grant, hasGrant := grants[key]
+	delete(grants, key)
+	op.grantsLock.Unlock()
+
+	if !hasGrant {
+		return nil, nil
+	}
+	if op.persistence != nil {
+		if err := op.persistence.Delete(collection, key); err != nil {
+			return nil, err
+		}
+	}
+	if time.Now().UTC().After(grant.Expires) {
+		return nil, nil
+	}
+	return grant, nil
+}
+
+// verifyCodeChallenge checks a PKCE code verifier (RFC 7636); grants without a challenge need no verifier.
+func verifyCodeChallenge(challenge, method, verifier string) bool {
+	if len(challenge) == 0 {
+		return true
+	}
+	if len(verifier) == 0 {
+		return false
+	}
+	computed := verifier
+	if method == "S256" {
+		digest := sha256.Sum256([]byte(verifier))
+		computed = base64URLEncode(digest[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// scopeContains returns if every space separated scope in `requested` is in `granted`.
+func scopeContains(granted, requested string) bool {
+	grantedScopes := map[string]bool{}
+	for _, scope := range strings.Fields(granted) {
+		grantedScopes[scope] = true
+	}
+	for _, scope := range strings.Fields(requested) {
+		if !grantedScopes[scope] {
+			return false
+		}
+	}
+	return true
+}
+
+func appendQuery(uri string, parameters url.Values) string {
+	separator := "?"
+	if strings.Contains(uri, "?") {
+		separator = "&"
+	}
+	return uri + separator + parameters.Encode()
+}
+
+func randomToken() string {
+	contents := make([]byte, 32)
+	if _, err := rand.Read(contents); err != nil {
+		panic(err)
+	}
+	return base64URLEncode(contents)
+}
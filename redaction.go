@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+
+	logger "github.com/blendlabs/go-logger"
+	web "github.com/blendlabs/go-web"
+)
+
+// newRedactor returns the redactor for logs, `/headers`, `/config` and callback reports: the defaults, plus
+// `LOG_REDACT_KEYS`, `LOG_REDACT_HEADERS` and `LOG_REDACT_JSON_PATHS`, plus the config.
+func newRedactor(cfg redactionConfig) *logger.Redactor {
+	return logger.NewRedactorFromEnvironment().
+		WithKeys(cfg.Keys...).
+		WithHeaders(cfg.Headers...).
+		WithJSONPaths(cfg.JSONPaths...)
+}
+
+// redactYAML redacts the values of sensitive keys (and at the json paths) in a yaml document.
+// The parsed document is what's redacted; the file is redacted line by line so its comments are kept, but only if that
+// parses back to the redacted document, which it doesn't for i.e. flow collections (`{client_secret: x}`), in which
+// case the redacted document is encoded instead.
+func redactYAML(redactor *logger.Redactor, contents []byte) ([]byte, error) {
+	document, err := web.ParseYAML(contents)
+	if err != nil {
+		return nil, err
+	}
+	if !redactor.Document(document) {
+		return contents, nil
+	}
+	lines := redactYAMLLines(redactor, contents)
+	if parsed, err := web.ParseYAML(lines); err == nil && reflect.DeepEqual(parsed, document) {
+		return lines, nil
+	}
+	return web.MarshalYAML(document)
+}
+
+// redactYAMLLines redacts the values of sensitive keys in block style yaml, line by line so the rest of the document
+// (and its comments) is unchanged; a sensitive key with a nested or multiline value has the whole value replaced.
+func redactYAMLLines(redactor *logger.Redactor, contents []byte) []byte {
+	quoted := strconv.Quote(logger.RedactedValue)
+	output := bytes.NewBuffer(nil)
+	redactingIndent := -1
+	for _, line := range strings.SplitAfter(string(contents), "\n") {
+		trimmed := strings.TrimLeft(line, " -")
+		indent := len(line) - len(trimmed)
+		body := strings.TrimSpace(trimmed)
+		if redactingIndent >= 0 {
+			if len(body) == 0 || indent > redactingIndent {
+				continue
+			}
+			redactingIndent = -1
+		}
+
+		colon := strings.Index(body, ":")
+		if len(body) == 0 || body[0] == '#' || colon < 0 || (colon+1 < len(body) && body[colon+1] != ' ') {
+			output.WriteString(line)
+			continue
+		}
+		key := strings.Trim(body[:colon], `'"`)
+		if !redactor.IsSensitiveKey(key) {
+			output.WriteString(line)
+			continue
+		}
+		value := strings.TrimSpace(body[colon+1:])
+		if len(value) == 0 || value[0] == '|' || value[0] == '>' || value[0] == '#' {
+			redactingIndent = indent
+		}
+		output.WriteString(line[:indent])
+		output.WriteString(body[:colon+1])
+		output.WriteRune(' ')
+		output.WriteString(quoted)
+		if strings.HasSuffix(line, "\n") {
+			output.WriteRune('\n')
+		}
+	}
+	return output.Bytes()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	logger "github.com/blendlabs/go-logger"
+	web "github.com/blendlabs/go-web"
+)
+
+func TestRedactYAML(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+		expected string
+		// keepsFile is set if the redacted file (comments and all) is expected rather than the re-encoded document.
+		keepsFile bool
+	}{
+		{
+			name:      "plain value",
+			contents:  "# the signing secret\nclient_secret: hunter2 # inline\nname: echo\n",
+			expected:  "# the signing secret\nclient_secret: \"[REDACTED]\"\nname: echo\n",
+			keepsFile: true,
+		},
+		{
+			name:      "nested block value",
+			contents:  "oidc:\n  clients:\n  # the service client\n  - client_id: svc\n    client_secret: hunter2\n  - client_id: spa\n",
+			expected:  "oidc:\n  clients:\n  # the service client\n  - client_id: svc\n    client_secret: \"[REDACTED]\"\n  - client_id: spa\n",
+			keepsFile: true,
+		},
+		{
+			name:      "mapping under a sensitive key",
+			contents:  "credentials:\n  user: admin\n  hunter2: true\nname: echo\n",
+			expected:  "credentials: \"[REDACTED]\"\nname: echo\n",
+			keepsFile: true,
+		},
+		{
+			name:      "block scalar",
+			contents:  "private_key: |\n  -----BEGIN hunter2-----\n  -----END-----\nname: echo\n",
+			expected:  "private_key: \"[REDACTED]\"\nname: echo\n",
+			keepsFile: true,
+		},
+		{
+			name:     "flow mapping in a sequence",
+			contents: "# clients\nclients:\n- {client_id: svc, client_secret: hunter2}\n",
+			expected: "clients:\n- client_id: svc\n  client_secret: \"[REDACTED]\"\n",
+		},
+		{
+			name:     "nested flow mappings",
+			contents: "webhooks:\n  schemes: {stripe: {secret: hunter2, tolerance: 5m}}\n",
+			expected: "webhooks:\n  schemes:\n    stripe:\n      secret: \"[REDACTED]\"\n      tolerance: 5m\n",
+		},
+		{
+			name:     "flow sequence under a sensitive key",
+			contents: "api_keys: [hunter2, hunter3]\nname: echo\n",
+			expected: "api_keys: \"[REDACTED]\"\nname: echo\n",
+		},
+		{
+			name:      "nothing sensitive",
+			contents:  "# as is\nname: echo\nclients: [{client_id: svc}]\n",
+			expected:  "# as is\nname: echo\nclients: [{client_id: svc}]\n",
+			keepsFile: true,
+		},
+	}
+
+	redactor := logger.NewRedactor()
+	for _, testCase := range testCases {
+		redacted, err := redactYAML(redactor, []byte(testCase.contents))
+		if err != nil {
+			t.Errorf("%s: %v", testCase.name, err)
+			continue
+		}
+		if strings.Contains(string(redacted), "hunter") {
+			t.Errorf("%s: expected the secrets to be redacted, got:\n%s", testCase.name, redacted)
+		}
+		if testCase.keepsFile && string(redacted) != testCase.expected {
+			t.Errorf("%s: expected the file to be kept:\n%s\ngot:\n%s", testCase.name, testCase.expected, redacted)
+		}
+
+		document, err := web.ParseYAML(redacted)
+		if err != nil {
+			t.Errorf("%s: redacted yaml doesn't parse: %v\n%s", testCase.name, err, redacted)
+			continue
+		}
+		expected, err := web.ParseYAML([]byte(testCase.expected))
+		if err != nil {
+			t.Fatalf("%s: %v", testCase.name, err)
+		}
+		if !reflect.DeepEqual(document, expected) {
+			t.Errorf("%s: expected %#v, got %#v", testCase.name, expected, document)
+		}
+	}
+}
+
+func TestRedactYAMLRejectsInvalidYAML(t *testing.T) {
+	if _, err := redactYAML(logger.NewRedactor(), []byte("clients: [a, b\n")); err == nil {
+		t.Error("expected an error for yaml that doesn't parse")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	web "github.com/blendlabs/go-web"
+)
+
+const (
+	// maxRedirects is the longest redirect chain the redirect endpoints will generate.
+	maxRedirects = 100
+)
+
+// redirectReport is what the final hop of a redirect chain received.
+type redirectReport struct {
+	Method      string `json:"method" xml:"method" yaml:"method"`
+	URL         string `json:"url" xml:"url" yaml:"url"`
+	ContentType string `json:"content_type,omitempty" xml:"content_type,omitempty" yaml:"content_type,omitempty"`
+	BodyBytes   int    `json:"body_bytes" xml:"body_bytes" yaml:"body_bytes"`
+	Body        string `json:"body,omitempty" xml:"body,omitempty" yaml:"body,omitempty"`
+}
+
+// String returns the report as `Key: value` lines.
+func (rr redirectReport) String() string {
+	buffer := bytes.NewBuffer(nil)
+	fmt.Fprintf(buffer, "Method: %s\n", rr.Method)
+	fmt.Fprintf(buffer, "URL: %s\n", rr.URL)
+	if len(rr.ContentType) > 0 {
+		fmt.Fprintf(buffer, "Content-Type: %s\n", rr.ContentType)
+	}
+	fmt.Fprintf(buffer, "Body-Bytes: %d\n", rr.BodyBytes)
+	if len(rr.Body) > 0 {
+		fmt.Fprintf(buffer, "\n%s\n", rr.Body)
+	}
+	return buffer.String()
+}
+
+// handleRedirect registers a redirect action for every common method, so method changes between hops can be observed.
+func handleRedirect(app *web.App, path string, action web.Action) {
+	app.GET(path, action)
+	app.HEAD(path, action)
+	app.POST(path, action)
+	app.PUT(path, action)
+	app.PATCH(path, action)
+	app.DELETE(path, action)
+	app.OPTIONS(path, action)
+}
+
+// redirect is `/redirect/:n`; it redirects with relative locations unless `?absolute=true`.
+func redirect(r *web.Ctx) web.Result {
+	absolute, _ := strconv.ParseBool(r.Request.URL.Query().Get("absolute"))
+	return redirectChain(r, "/redirect", absolute)
+}
+
+// absoluteRedirect is `/absolute-redirect/:n`.
+func absoluteRedirect(r *web.Ctx) web.Result {
+	return redirectChain(r, "/absolute-redirect", true)
+}
+
+// relativeRedirect is `/relative-redirect/:n`.
+func relativeRedirect(r *web.Ctx) web.Result {
+	return redirectChain(r, "/relative-redirect", false)
+}
+
+// redirectChain redirects `n` times to `{prefix}/{n-1}`, and `{prefix}/0` reports what it received.
+// Every hop uses `?status=` (default 302) and keeps the query string, so the chain is deterministic.
+// With `?loop=k` the hop after `{prefix}/1` is `{prefix}/k` rather than `{prefix}/0`, so the chain never ends.
+func redirectChain(r *web.Ctx, prefix string, absolute bool) web.Result {
+	count, _ := r.RouteParam("n")
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 || n > maxRedirects {
+		return r.Negotiated().BadRequest(fmt.Sprintf("invalid redirect count `%s`; expected 0 to %d", count, maxRedirects))
+	}
+	if n == 0 {
+		return reportRedirected(r)
+	}
+
+	statusCode, err := redirectStatus(r)
+	if err != nil {
+		return r.Negotiated().BadRequest(err.Error())
+	}
+
+	next := n - 1
+	if loop := r.Request.URL.Query().Get("loop"); len(loop) > 0 {
+		loopTo, err := strconv.Atoi(loop)
+		if err != nil || loopTo < 1 || loopTo > maxRedirects {
+			return r.Negotiated().BadRequest(fmt.Sprintf("invalid loop `%s`; expected 1 to %d", loop, maxRedirects))
+		}
+		if next == 0 {
+			next = loopTo
+		}
+	}
+
+	location := fmt.Sprintf("%s/%d", prefix, next)
+	if len(r.Request.URL.RawQuery) > 0 {
+		location = location + "?" + r.Request.URL.RawQuery
+	}
+	if absolute {
+		location = requestBaseURL(r) + location
+	}
+	return r.RedirectWithStatusf(statusCode, "%s", location)
+}
+
+// redirectTo is `/redirect-to?url=&status=`.
+func redirectTo(r *web.Ctx) web.Result {
+	location, err := r.QueryParam("url")
+	if err != nil {
+		return r.Negotiated().BadRequest("`url` is required")
+	}
+	if _, err := url.Parse(location); err != nil {
+		return r.Negotiated().BadRequest(fmt.Sprintf("invalid url `%s`", location))
+	}
+	statusCode, err := redirectStatus(r)
+	if err != nil {
+		return r.Negotiated().BadRequest(err.Error())
+	}
+	return r.RedirectWithStatusf(statusCode, "%s", location)
+}
+
+// redirected is `/redirected`, a convenient final hop for `/redirect-to`.
+func redirected(r *web.Ctx) web.Result {
+	return reportRedirected(r)
+}
+
+func reportRedirected(r *web.Ctx) web.Result {
+	body, err := r.PostBody()
+	if err != nil {
+		return r.Negotiated().InternalError(err)
+	}
+	return r.Negotiated().Result(redirectReport{
+		Method:      r.Request.Method,
+		URL:         r.Request.URL.String(),
+		ContentType: r.Request.Header.Get(web.HeaderContentType),
+		BodyBytes:   len(body),
+		Body:        string(body),
+	})
+}
+
+func redirectStatus(r *web.Ctx) (int, error) {
+	status := r.Request.URL.Query().Get("status")
+	if len(status) == 0 {
+		return http.StatusFound, nil
+	}
+	statusCode, err := strconv.Atoi(status)
+	if err != nil || !web.IsRedirectStatus(statusCode) {
+		return 0, fmt.Errorf("invalid status `%s`; expected 301, 302, 303, 307 or 308", status)
+	}
+	return statusCode, nil
+}
+
+// requestBaseURL returns the scheme and host the request was made to, honoring `X-Forwarded-Proto`.
+func requestBaseURL(r *web.Ctx) string {
+	scheme := "http"
+	if r.Request.TLS != nil {
+		scheme = "https"
+	}
+	if forwarded := r.Request.Header.Get("X-Forwarded-Proto"); len(forwarded) > 0 {
+		scheme = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return scheme + "://" + r.Request.Host
+}
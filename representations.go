@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	web "github.com/blendlabs/go-web"
+)
+
+// headers are request headers that render sensibly as json, xml, yaml and text.
+type headers http.Header
+
+// String returns the headers in wire format, one `Name: value` per line.
+func (h headers) String() string {
+	buffer := bytes.NewBuffer(nil)
+	for _, name := range h.names() {
+		for _, value := range h[name] {
+			buffer.WriteString(name)
+			buffer.WriteString(": ")
+			buffer.WriteString(value)
+			buffer.WriteRune('\n')
+		}
+	}
+	return buffer.String()
+}
+
+// MarshalXML renders the headers as `<headers><header name="...">value</header></headers>`.
+func (h headers) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = xml.Name{Local: "headers"}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, name := range h.names() {
+		for _, value := range h[name] {
+			header := xml.StartElement{
+				Name: xml.Name{Local: "header"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: name}},
+			}
+			if err := e.EncodeElement(value, header); err != nil {
+				return err
+			}
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func (h headers) names() []string {
+	var names []string
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// envVars are environment variable names that render sensibly as json, xml, yaml and text.
+type envVars []string
+
+// String returns the variables one per line.
+func (ev envVars) String() string {
+	return strings.Join(ev, "\n") + "\n"
+}
+
+// MarshalXML renders the variables as `<env><var>NAME</var></env>`.
+func (ev envVars) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = xml.Name{Local: "env"}
+	return e.EncodeElement(struct {
+		Vars []string `xml:"var"`
+	}{Vars: ev}, start)
+}
+
+// configDocument is the (redacted) config file; it renders as the file itself for yaml and text,
+// and as the parsed document for json and xml.
+type configDocument struct {
+	contents []byte
+	document interface{}
+}
+
+// newConfigDocument returns the config document for (redacted) yaml contents; contents that don't parse
+// are represented as a string.
+func newConfigDocument(contents []byte) configDocument {
+	document, err := web.ParseYAML(contents)
+	if err != nil {
+		document = string(contents)
+	}
+	return configDocument{contents: contents, document: document}
+}
+
+// String returns the config file.
+func (cd configDocument) String() string {
+	return string(cd.contents)
+}
+
+// MarshalJSON renders the parsed document.
+func (cd configDocument) MarshalJSON() ([]byte, error) {
+	return json.Marshal(cd.document)
+}
+
+// MarshalXML renders the parsed document as `<config>`, with mapping entries as `<entry key="...">`
+// and sequence items as `<item>`.
+func (cd configDocument) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = xml.Name{Local: "config"}
+	return encodeXMLValue(e, start, cd.document)
+}
+
+// encodeXMLValue encodes a parsed yaml value as an element.
+func encodeXMLValue(e *xml.Encoder, start xml.StartElement, value interface{}) error {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if err := e.EncodeToken(start); err != nil {
+			return err
+		}
+		var keys []string
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			entry := xml.StartElement{
+				Name: xml.Name{Local: "entry"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}},
+			}
+			if err := encodeXMLValue(e, entry, typed[key]); err != nil {
+				return err
+			}
+		}
+		return e.EncodeToken(start.End())
+	case []interface{}:
+		if err := e.EncodeToken(start); err != nil {
+			return err
+		}
+		for _, item := range typed {
+			if err := encodeXMLValue(e, xml.StartElement{Name: xml.Name{Local: "item"}}, item); err != nil {
+				return err
+			}
+		}
+		return e.EncodeToken(start.End())
+	case nil:
+		return e.EncodeElement("", start)
+	}
+	return e.EncodeElement(fmt.Sprintf("%v", value), start)
+}
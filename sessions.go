@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+
+	web "github.com/blendlabs/go-web"
+)
+
+const (
+	// sessionStateName is the session state key `/session/login?name=` is kept under.
+	sessionStateName = "name"
+
+	// sessionSecretCollection and sessionSecretKey are where a generated session secret is persisted.
+	sessionSecretCollection = "secrets"
+	sessionSecretKey        = "session"
+)
+
+// sessionReport describes a session.
+type sessionReport struct {
+	XMLName       xml.Name   `json:"-" xml:"session" yaml:"-"`
+	Authenticated bool       `json:"authenticated" xml:"authenticated" yaml:"authenticated"`
+	UserID        int64      `json:"user_id,omitempty" xml:"user_id,omitempty" yaml:"user_id,omitempty"`
+	Name          string     `json:"name,omitempty" xml:"name,omitempty" yaml:"name,omitempty"`
+	SessionID     string     `json:"session_id,omitempty" xml:"session_id,omitempty" yaml:"session_id,omitempty"`
+	CreatedUTC    *time.Time `json:"created_utc,omitempty" xml:"created_utc,omitempty" yaml:"created_utc,omitempty"`
+	LastSeenUTC   *time.Time `json:"last_seen_utc,omitempty" xml:"last_seen_utc,omitempty" yaml:"last_seen_utc,omitempty"`
+	ExpiresUTC    *time.Time `json:"expires_utc,omitempty" xml:"expires_utc,omitempty" yaml:"expires_utc,omitempty"`
+	UserSessions  int        `json:"user_sessions,omitempty" xml:"user_sessions,omitempty" yaml:"user_sessions,omitempty"`
+	Error         string     `json:"error,omitempty" xml:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// String returns the report as `Key: value` lines.
+func (sr sessionReport) String() string {
+	buffer := bytes.NewBuffer(nil)
+	fmt.Fprintf(buffer, "Authenticated: %v\n", sr.Authenticated)
+	if sr.UserID != 0 {
+		fmt.Fprintf(buffer, "User ID: %d\n", sr.UserID)
+	}
+	if len(sr.Name) > 0 {
+		fmt.Fprintf(buffer, "Name: %s\n", sr.Name)
+	}
+	if len(sr.SessionID) > 0 {
+		fmt.Fprintf(buffer, "Session ID: %s\n", sr.SessionID)
+	}
+	if sr.CreatedUTC != nil {
+		fmt.Fprintf(buffer, "Created: %s\n", sr.CreatedUTC.Format(time.RFC3339))
+	}
+	if sr.LastSeenUTC != nil {
+		fmt.Fprintf(buffer, "Last Seen: %s\n", sr.LastSeenUTC.Format(time.RFC3339))
+	}
+	if sr.ExpiresUTC != nil {
+		fmt.Fprintf(buffer, "Expires: %s\n", sr.ExpiresUTC.Format(time.RFC3339))
+	}
+	if sr.UserSessions > 0 {
+		fmt.Fprintf(buffer, "User Sessions: %d\n", sr.UserSessions)
+	}
+	if len(sr.Error) > 0 {
+		fmt.Fprintf(buffer, "Error: %s\n", sr.Error)
+	}
+	return buffer.String()
+}
+
+// newSessions configures an auth manager with an in memory session store and returns the `/session` endpoints.
+// If a persistence is given, sessions are also kept in it and loaded from it with the expiry they were saved with;
+// sessions that expired while the server was down are not loaded.
+func newSessions(cfg sessionConfig, auth *web.AuthManager, persistence web.Persistence) (*sessions, error) {
+	ttl := cfg.TTL
+	if ttl == 0 {
+		ttl = web.DefaultSessionTTL
+	}
+	secret, err := sessionSecret(cfg, persistence)
+	if err != nil {
+		return nil, err
+	}
+
+	store := web.NewMemorySessionStore(ttl)
+	store.SetSlidingExpiration(cfg.SlidingExpiration)
+	store.SetMaxSessionsPerUser(cfg.MaxSessionsPerUser)
+	if persistence != nil {
+		store.SetEvictionHandler(func(session *web.Session) {
+			persistence.Delete(web.SessionsCollection, session.SessionID)
+		})
+		if err := web.LoadSessions(persistence, store); err != nil {
+			return nil, err
+		}
+		auth.SetSessionPersistence(persistence)
+	}
+	store.Start()
+
+	auth.SetSecret(secret)
+	auth.SetSessionStore(store)
+	return &sessions{store: store, persistence: persistence}, nil
+}
+
+// sessionSecret returns the configured secret, or a random one that is kept in the persistence (if any)
+// so secure session ids stay valid across restarts.
+func sessionSecret(cfg sessionConfig, persistence web.Persistence) ([]byte, error) {
+	if len(cfg.Secret) > 0 {
+		secret, err := web.Base64.Decode(cfg.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("session secret must be base64 encoded: %v", err)
+		}
+		return secret, nil
+	}
+	if persistence == nil {
+		return web.GenerateSHA512Key(), nil
+	}
+	secret, hasSecret, err := persistence.Get(sessionSecretCollection, sessionSecretKey)
+	if err != nil || hasSecret {
+		return secret, err
+	}
+	secret = web.GenerateSHA512Key()
+	return secret, persistence.Put(sessionSecretCollection, sessionSecretKey, secret)
+}
+
+// sessions are endpoints that log in, log out and describe sessions.
+type sessions struct {
+	store       *web.MemorySessionStore
+	persistence web.Persistence
+}
+
+// Register adds the session routes to an app.
+func (s *sessions) Register(app *web.App) {
+	app.GET("/session/login", s.login)
+	app.POST("/session/login", s.login)
+	app.GET("/session/logout", s.logout, web.SessionAware)
+	app.POST("/session/logout", s.logout, web.SessionAware)
+	app.GET("/session/whoami", s.whoami, web.SessionAware)
+}
+
+// login logs in `?user_id=` (default 1), optionally keeping `?name=` in the session state.
+func (s *sessions) login(r *web.Ctx) web.Result {
+	userID := int64(1)
+	if value := r.Param("user_id"); len(value) > 0 {
+		parsed, err := r.ParamInt64("user_id")
+		if err != nil || parsed <= 0 {
+			return r.Negotiated().BadRequest(fmt.Sprintf("invalid user_id `%s`", value))
+		}
+		userID = parsed
+	}
+
+	session, err := r.Auth().Login(userID, r)
+	if err != nil {
+		return r.Negotiated().InternalError(err)
+	}
+	if name := r.Param(sessionStateName); len(name) > 0 {
+		session.Lock()
+		session.State[sessionStateName] = name
+		session.Unlock()
+		if err := s.persist(session); err != nil {
+			return r.Negotiated().InternalError(err)
+		}
+	}
+	return r.Negotiated().Result(s.report(session))
+}
+
+// logout logs the current session out.
+func (s *sessions) logout(r *web.Ctx) web.Result {
+	session := r.Session()
+	if session == nil {
+		return r.Negotiated().ResultWithStatus(http.StatusUnauthorized, sessionReport{Error: "no session"})
+	}
+	report := s.report(session)
+	report.Authenticated = false
+	report.LastSeenUTC, report.ExpiresUTC, report.UserSessions = nil, nil, 0
+
+	if err := r.Auth().Logout(session, r); err != nil {
+		return r.Negotiated().InternalError(err)
+	}
+	return r.Negotiated().Result(report)
+}
+
+// whoami describes the current session.
+func (s *sessions) whoami(r *web.Ctx) web.Result {
+	session := r.Session()
+	if session == nil {
+		return r.Negotiated().ResultWithStatus(http.StatusUnauthorized, sessionReport{Error: "no session"})
+	}
+	return r.Negotiated().Result(s.report(session))
+}
+
+// persist saves a session after its state changes; `Login` only persists it as created.
+func (s *sessions) persist(session *web.Session) error {
+	if s.persistence == nil {
+		return nil
+	}
+	expiry, _ := s.store.Expiry(session.SessionID)
+	contents, err := web.MarshalSessionWithExpiry(session, expiry)
+	if err != nil {
+		return err
+	}
+	return s.persistence.Put(web.SessionsCollection, session.SessionID, contents)
+}
+
+// Close stops evicting expired sessions and saves every session with its current expiry, so a restart
+// neither renews nor loses them.
+func (s *sessions) Close() error {
+	s.store.Stop()
+	if s.persistence == nil {
+		return nil
+	}
+	return web.SaveSessions(s.persistence, s.store)
+}
+
+// report describes a session.
+func (s *sessions) report(session *web.Session) sessionReport {
+	created := session.CreatedUTC
+	report := sessionReport{
+		Authenticated: true,
+		UserID:        session.UserID,
+		SessionID:     session.SessionID,
+		CreatedUTC:    &created,
+		UserSessions:  s.store.UserSessionCount(session.UserID),
+	}
+	if name, ok := session.State[sessionStateName].(string); ok {
+		report.Name = name
+	}
+	if expiry, ok := s.store.Expiry(session.SessionID); ok {
+		report.LastSeenUTC = &expiry.LastSeenUTC
+		if !expiry.ExpiresUTC.IsZero() {
+			report.ExpiresUTC = &expiry.ExpiresUTC
+		}
+	}
+	return report
+}
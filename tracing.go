@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+
+	web "github.com/blendlabs/go-web"
+)
+
+const (
+	// traceMaxChildren is the most child spans `/trace?children=` generates.
+	traceMaxChildren = 16
+	// traceDefaultServiceName is the service name spans are exported with if the config doesn't set one.
+	traceDefaultServiceName = "echo"
+)
+
+// traceStateEntry is a `key=value` pair of the received tracestate.
+type traceStateEntry struct {
+	Key   string `json:"key" xml:"key,attr" yaml:"key"`
+	Value string `json:"value" xml:",chardata" yaml:"value"`
+}
+
+// traceChild is a child span id and the traceparent echo would send to a callee under it.
+type traceChild struct {
+	SpanID      string `json:"span_id" xml:"span_id,attr" yaml:"span_id"`
+	TraceParent string `json:"traceparent" xml:",chardata" yaml:"traceparent"`
+}
+
+// traceReport is the trace context a request arrived with and the spans echo created for it.
+type traceReport struct {
+	XMLName          xml.Name          `json:"-" xml:"trace" yaml:"-"`
+	TraceParent      string            `json:"traceparent_header,omitempty" xml:"traceparent_header,omitempty" yaml:"traceparent_header,omitempty"`
+	TraceState       string            `json:"tracestate_header,omitempty" xml:"tracestate_header,omitempty" yaml:"tracestate_header,omitempty"`
+	Continued        bool              `json:"continued" xml:"continued" yaml:"continued"`
+	Error            string            `json:"error,omitempty" xml:"error,omitempty" yaml:"error,omitempty"`
+	StateError       string            `json:"tracestate_error,omitempty" xml:"tracestate_error,omitempty" yaml:"tracestate_error,omitempty"`
+	Version          string            `json:"version,omitempty" xml:"version,omitempty" yaml:"version,omitempty"`
+	TraceID          string            `json:"trace_id" xml:"trace_id" yaml:"trace_id"`
+	ParentID         string            `json:"parent_id,omitempty" xml:"parent_id,omitempty" yaml:"parent_id,omitempty"`
+	Flags            string            `json:"flags" xml:"flags" yaml:"flags"`
+	Sampled          bool              `json:"sampled" xml:"sampled" yaml:"sampled"`
+	State            []traceStateEntry `json:"tracestate,omitempty" xml:"tracestate,omitempty" yaml:"tracestate,omitempty"`
+	SpanID           string            `json:"span_id" xml:"span_id" yaml:"span_id"`
+	ChildTraceParent string            `json:"child_traceparent" xml:"child_traceparent" yaml:"child_traceparent"`
+	Children         []traceChild      `json:"children" xml:"child" yaml:"children"`
+}
+
+// String returns the report as `Key: value` lines with a line per tracestate entry and child.
+func (tr traceReport) String() string {
+	buffer := bytes.NewBuffer(nil)
+	if len(tr.TraceParent) > 0 {
+		fmt.Fprintf(buffer, "traceparent: %s\n", tr.TraceParent)
+	}
+	if len(tr.TraceState) > 0 {
+		fmt.Fprintf(buffer, "tracestate: %s\n", tr.TraceState)
+	}
+	if len(tr.Error) > 0 {
+		fmt.Fprintf(buffer, "Error: %s\n", tr.Error)
+	}
+	if len(tr.StateError) > 0 {
+		fmt.Fprintf(buffer, "Tracestate Error: %s\n", tr.StateError)
+	}
+	fmt.Fprintf(buffer, "Continued: %v\n", tr.Continued)
+	if len(tr.Version) > 0 {
+		fmt.Fprintf(buffer, "Version: %s\n", tr.Version)
+	}
+	fmt.Fprintf(buffer, "Trace ID: %s\n", tr.TraceID)
+	if len(tr.ParentID) > 0 {
+		fmt.Fprintf(buffer, "Parent ID: %s\n", tr.ParentID)
+	}
+	fmt.Fprintf(buffer, "Flags: %s (sampled: %v)\n", tr.Flags, tr.Sampled)
+	for _, entry := range tr.State {
+		fmt.Fprintf(buffer, "  %s=%s\n", entry.Key, entry.Value)
+	}
+	fmt.Fprintf(buffer, "Span ID: %s\n", tr.SpanID)
+	fmt.Fprintf(buffer, "Child traceparent: %s\n", tr.ChildTraceParent)
+	for _, child := range tr.Children {
+		fmt.Fprintf(buffer, "  %s %s\n", child.SpanID, child.TraceParent)
+	}
+	return buffer.String()
+}
+
+// newTracer returns the tracer for the config; spans are only exported if a file or an otlp endpoint is configured.
+func newTracer(cfg tracingConfig) (*web.Tracer, error) {
+	serviceName := cfg.ServiceName
+	if len(serviceName) == 0 {
+		serviceName = traceDefaultServiceName
+	}
+	var exporter web.SpanExporter
+	switch {
+	case len(cfg.File) > 0 && len(cfg.OTLPEndpoint) > 0:
+		return nil, fmt.Errorf("invalid tracing config; set one of `file` or `otlp_endpoint`")
+	case len(cfg.File) > 0:
+		fileExporter, err := web.NewFileSpanExporter(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		exporter = fileExporter
+	case len(cfg.OTLPEndpoint) > 0:
+		otlpExporter := web.NewOTLPSpanExporter(cfg.OTLPEndpoint)
+		for key, value := range cfg.OTLPHeaders {
+			otlpExporter.WithHeader(key, value)
+		}
+		exporter = otlpExporter
+	}
+	tracer := web.NewTracer(serviceName, exporter)
+	if cfg.FlushInterval > 0 {
+		tracer.SetFlushInterval(cfg.FlushInterval)
+	}
+	return tracer, nil
+}
+
+// trace reports the received `traceparent` and `tracestate` headers as parsed, the server span echo started,
+// and `?children=n` (default 1) child span ids with the traceparent echo would send under each.
+func trace(r *web.Ctx) web.Result {
+	children := 1
+	if value := r.Request.URL.Query().Get("children"); len(value) > 0 {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || parsed > traceMaxChildren {
+			return r.Negotiated().BadRequest(fmt.Sprintf("invalid children; expected between 0 and %d", traceMaxChildren))
+		}
+		children = parsed
+	}
+
+	span := r.Span()
+	if span == nil {
+		return r.Negotiated().InternalError(fmt.Errorf("tracing is not enabled"))
+	}
+
+	report := traceReport{
+		TraceParent: r.Request.Header.Get(web.HeaderTraceParent),
+		TraceState:  r.Request.Header.Get(web.HeaderTraceState),
+		TraceID:     span.TraceID,
+		SpanID:      span.SpanID,
+		Children:    []traceChild{},
+	}
+	if _, err := web.ParseTraceParent(report.TraceParent); err != nil && len(report.TraceParent) > 0 {
+		report.Error = err.Error()
+	}
+	if _, err := web.ParseTraceState(report.TraceState); err != nil {
+		report.StateError = err.Error()
+	}
+
+	if received := r.TraceContext(); received != nil {
+		report.Continued = true
+		report.Version = fmt.Sprintf("%02x", received.Version)
+		report.ParentID = received.ParentID
+		for _, entry := range received.State {
+			report.State = append(report.State, traceStateEntry{Key: entry.Key, Value: entry.Value})
+		}
+	}
+	outgoing := r.ChildTraceContext()
+	report.Flags = fmt.Sprintf("%02x", outgoing.Flags)
+	report.Sampled = outgoing.Sampled()
+	report.ChildTraceParent = outgoing.TraceParent()
+
+	for x := 0; x < children; x++ {
+		child := outgoing.Child(web.NewSpanID())
+		report.Children = append(report.Children, traceChild{SpanID: child.ParentID, TraceParent: child.TraceParent()})
+	}
+	return r.Negotiated().Result(report)
+}
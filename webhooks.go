@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	util "github.com/blendlabs/go-util"
+	web "github.com/blendlabs/go-web"
+)
+
+const (
+	webhookTypeGeneric  = "generic"
+	webhookTypeGitHub   = "github"
+	webhookTypeStripe   = "stripe"
+	webhookTypeSlack    = "slack"
+	webhookTypeShopify  = "shopify"
+	webhookTypeStandard = "standard"
+
+	// webhookDefaultTolerance is how far a signature timestamp can be from now, either way.
+	webhookDefaultTolerance = 5 * time.Minute
+
+	// webhookStandardSecretPrefix prefixes base64 encoded Standard Webhooks secrets.
+	webhookStandardSecretPrefix = "whsec_"
+)
+
+// webhookTypes are the built in signature schemes and their default headers.
+var webhookTypes = map[string]webhookSchemeConfig{
+	webhookTypeGeneric:  {Header: "X-Signature"},
+	webhookTypeGitHub:   {Header: "X-Hub-Signature-256"},
+	webhookTypeStripe:   {Header: "Stripe-Signature"},
+	webhookTypeSlack:    {Header: "X-Slack-Signature", TimestampHeader: "X-Slack-Request-Timestamp"},
+	webhookTypeShopify:  {Header: "X-Shopify-Hmac-Sha256"},
+	webhookTypeStandard: {Header: "webhook-signature", TimestampHeader: "webhook-timestamp", IDHeader: "webhook-id"},
+}
+
+// webhookReport is the outcome of verifying a webhook signature.
+type webhookReport struct {
+	XMLName   xml.Name   `json:"-" xml:"webhook" yaml:"-"`
+	Scheme    string     `json:"scheme" xml:"scheme" yaml:"scheme"`
+	Type      string     `json:"type" xml:"type" yaml:"type"`
+	Matched   bool       `json:"matched" xml:"matched" yaml:"matched"`
+	Reason    string     `json:"reason,omitempty" xml:"reason,omitempty" yaml:"reason,omitempty"`
+	Header    string     `json:"header" xml:"header" yaml:"header"`
+	Received  []string   `json:"received,omitempty" xml:"received,omitempty" yaml:"received,omitempty"`
+	Algorithm string     `json:"algorithm,omitempty" xml:"algorithm,omitempty" yaml:"algorithm,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty" xml:"timestamp,omitempty" yaml:"timestamp,omitempty"`
+	Age       string     `json:"age,omitempty" xml:"age,omitempty" yaml:"age,omitempty"`
+	Tolerance string     `json:"tolerance,omitempty" xml:"tolerance,omitempty" yaml:"tolerance,omitempty"`
+	BodyBytes int        `json:"body_bytes" xml:"body_bytes" yaml:"body_bytes"`
+}
+
+// String returns the report as `Key: value` lines.
+func (wr webhookReport) String() string {
+	buffer := bytes.NewBuffer(nil)
+	fmt.Fprintf(buffer, "Scheme: %s (%s)\n", wr.Scheme, wr.Type)
+	fmt.Fprintf(buffer, "Matched: %v\n", wr.Matched)
+	if len(wr.Reason) > 0 {
+		fmt.Fprintf(buffer, "Reason: %s\n", wr.Reason)
+	}
+	fmt.Fprintf(buffer, "Header: %s\n", wr.Header)
+	for _, received := range wr.Received {
+		fmt.Fprintf(buffer, "Received: %s\n", received)
+	}
+	if len(wr.Algorithm) > 0 {
+		fmt.Fprintf(buffer, "Algorithm: %s\n", wr.Algorithm)
+	}
+	if wr.Timestamp != nil {
+		fmt.Fprintf(buffer, "Timestamp: %s (age %s, tolerance %s)\n", wr.Timestamp.Format(time.RFC3339), wr.Age, wr.Tolerance)
+	}
+	fmt.Fprintf(buffer, "Body Bytes: %d\n", wr.BodyBytes)
+	return buffer.String()
+}
+
+// webhookSignature is a webhook signature made by `/webhooks/sign`.
+type webhookSignature struct {
+	XMLName   xml.Name `json:"-" xml:"signature" yaml:"-"`
+	Scheme    string   `json:"scheme" xml:"scheme" yaml:"scheme"`
+	Type      string   `json:"type" xml:"type" yaml:"type"`
+	Algorithm string   `json:"algorithm" xml:"algorithm" yaml:"algorithm"`
+	Signature string   `json:"signature" xml:"value" yaml:"signature"`
+	Headers   headers  `json:"headers" xml:"headers" yaml:"headers"`
+}
+
+// String returns the headers to send with the body.
+func (ws webhookSignature) String() string {
+	return ws.Headers.String()
+}
+
+// webhookScheme is a signature scheme with its defaults applied.
+type webhookScheme struct {
+	Name            string
+	Type            string
+	Secret          string
+	Header          string
+	TimestampHeader string
+	IDHeader        string
+	Tolerance       time.Duration
+}
+
+// webhookCandidate is a signature sent with a webhook.
+type webhookCandidate struct {
+	Algorithm string
+	Value     []byte
+	Raw       string
+}
+
+// webhookReceived is the signature headers sent with a webhook.
+type webhookReceived struct {
+	ID         string
+	Timestamp  string
+	Candidates []webhookCandidate
+}
+
+// newWebhookScheme applies a type's defaults to a scheme config.
+func newWebhookScheme(name string, cfg webhookSchemeConfig) (webhookScheme, error) {
+	if len(cfg.Type) == 0 {
+		cfg.Type = name
+	}
+	defaults, isType := webhookTypes[cfg.Type]
+	if !isType {
+		return webhookScheme{}, fmt.Errorf("webhook scheme `%s`: unknown type `%s`", name, cfg.Type)
+	}
+	scheme := webhookScheme{
+		Name:            name,
+		Type:            cfg.Type,
+		Secret:          cfg.Secret,
+		Header:          cfg.Header,
+		TimestampHeader: cfg.TimestampHeader,
+		IDHeader:        cfg.IDHeader,
+		Tolerance:       cfg.Tolerance,
+	}
+	if len(scheme.Header) == 0 {
+		scheme.Header = defaults.Header
+	}
+	if len(scheme.TimestampHeader) == 0 {
+		scheme.TimestampHeader = defaults.TimestampHeader
+	}
+	if len(scheme.IDHeader) == 0 {
+		scheme.IDHeader = defaults.IDHeader
+	}
+	if scheme.Tolerance == 0 {
+		scheme.Tolerance = webhookDefaultTolerance
+	}
+	return scheme, nil
+}
+
+// Timestamped returns if the signature covers a timestamp, and so has a replay window.
+func (ws webhookScheme) Timestamped() bool {
+	return ws.Type == webhookTypeStripe || len(ws.TimestampHeader) > 0
+}
+
+// key returns the hmac key; Standard Webhooks secrets are base64 encoded after a `whsec_` prefix.
+func (ws webhookScheme) key() []byte {
+	if ws.Type == webhookTypeStandard {
+		if decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ws.Secret, webhookStandardSecretPrefix)); err == nil {
+			return decoded
+		}
+	}
+	return []byte(ws.Secret)
+}
+
+// signedPayload returns what the signature is computed over.
+func (ws webhookScheme) signedPayload(id, timestamp string, body []byte) []byte {
+	switch ws.Type {
+	case webhookTypeSlack:
+		return append([]byte("v0:"+timestamp+":"), body...)
+	case webhookTypeStandard:
+		return append([]byte(id+"."+timestamp+"."), body...)
+	}
+	if ws.Timestamped() {
+		return append([]byte(timestamp+"."), body...)
+	}
+	return body
+}
+
+// sign returns the hmac of a payload.
+func (ws webhookScheme) sign(algorithm string, payload []byte) []byte {
+	switch algorithm {
+	case "sha1":
+		return util.Crypto.HashSHA1(ws.key(), payload)
+	case "sha512":
+		return util.Crypto.Hash(ws.key(), payload)
+	}
+	return util.Crypto.HashSHA256(ws.key(), payload)
+}
+
+// encode returns a signature as the scheme sends it.
+func (ws webhookScheme) encode(signature []byte) string {
+	if ws.Type == webhookTypeShopify || ws.Type == webhookTypeStandard {
+		return base64.StdEncoding.EncodeToString(signature)
+	}
+	return hex.EncodeToString(signature)
+}
+
+// headers returns the signature headers to send with a body.
+func (ws webhookScheme) headers(id, timestamp string, signature []byte) headers {
+	encoded := ws.encode(signature)
+	var value string
+	switch ws.Type {
+	case webhookTypeStripe:
+		value = "t=" + timestamp + ",v1=" + encoded
+	case webhookTypeSlack:
+		value = "v0=" + encoded
+	case webhookTypeShopify:
+		value = encoded
+	case webhookTypeStandard:
+		value = "v1," + encoded
+	default:
+		value = "sha256=" + encoded
+	}
+
+	signed := headers{}
+	http.Header(signed).Set(ws.Header, value)
+	if len(ws.TimestampHeader) > 0 {
+		http.Header(signed).Set(ws.TimestampHeader, timestamp)
+	}
+	if len(ws.IDHeader) > 0 {
+		http.Header(signed).Set(ws.IDHeader, id)
+	}
+	return signed
+}
+
+// parse reads the signature headers sent with a webhook.
+func (ws webhookScheme) parse(header http.Header) (*webhookReceived, error) {
+	value := strings.TrimSpace(header.Get(ws.Header))
+	if len(value) == 0 {
+		return nil, fmt.Errorf("missing `%s` header", ws.Header)
+	}
+	received := &webhookReceived{}
+	if len(ws.TimestampHeader) > 0 {
+		if received.Timestamp = header.Get(ws.TimestampHeader); len(received.Timestamp) == 0 {
+			return nil, fmt.Errorf("missing `%s` header", ws.TimestampHeader)
+		}
+	}
+	if len(ws.IDHeader) > 0 {
+		if received.ID = header.Get(ws.IDHeader); len(received.ID) == 0 {
+			return nil, fmt.Errorf("missing `%s` header", ws.IDHeader)
+		}
+	}
+
+	switch ws.Type {
+	case webhookTypeStripe:
+		for _, part := range strings.Split(value, ",") {
+			pieces := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(pieces) != 2 {
+				continue
+			}
+			switch pieces[0] {
+			case "t":
+				received.Timestamp = pieces[1]
+			case "v1":
+				if decoded, err := hex.DecodeString(pieces[1]); err == nil {
+					received.Candidates = append(received.Candidates, webhookCandidate{Algorithm: "sha256", Value: decoded, Raw: part})
+				}
+			}
+		}
+		if len(received.Timestamp) == 0 {
+			return nil, fmt.Errorf("`%s` header has no `t=` timestamp", ws.Header)
+		}
+	case webhookTypeSlack:
+		if !strings.HasPrefix(value, "v0=") {
+			return nil, fmt.Errorf("`%s` header must start with `v0=`", ws.Header)
+		}
+		if decoded, err := hex.DecodeString(value[3:]); err == nil {
+			received.Candidates = append(received.Candidates, webhookCandidate{Algorithm: "sha256", Value: decoded, Raw: value})
+		}
+	case webhookTypeShopify:
+		if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+			received.Candidates = append(received.Candidates, webhookCandidate{Algorithm: "sha256", Value: decoded, Raw: value})
+		}
+	case webhookTypeStandard:
+		for _, part := range strings.Fields(value) {
+			if !strings.HasPrefix(part, "v1,") {
+				continue
+			}
+			if decoded, err := base64.StdEncoding.DecodeString(part[3:]); err == nil {
+				received.Candidates = append(received.Candidates, webhookCandidate{Algorithm: "sha256", Value: decoded, Raw: part})
+			}
+		}
+	default:
+		algorithm, encoded := "sha256", value
+		if index := strings.Index(value, "="); index > 0 {
+			algorithm, encoded = strings.ToLower(value[:index]), value[index+1:]
+		}
+		if algorithm != "sha1" && algorithm != "sha256" && algorithm != "sha512" {
+			return nil, fmt.Errorf("unsupported algorithm `%s`; expected sha1, sha256 or sha512", algorithm)
+		}
+		if decoded, err := hex.DecodeString(encoded); err == nil {
+			received.Candidates = append(received.Candidates, webhookCandidate{Algorithm: algorithm, Value: decoded, Raw: value})
+		}
+	}
+	if len(received.Candidates) == 0 {
+		return nil, fmt.Errorf("`%s` header has no signature in the expected format", ws.Header)
+	}
+	return received, nil
+}
+
+// newWebhooks returns the webhook endpoints for the configured schemes.
+func newWebhooks(cfg webhooksConfig) (*webhooks, error) {
+	wh := &webhooks{
+		schemes: map[string]webhookScheme{},
+		seen:    map[string]time.Time{},
+	}
+	for name, schemeConfig := range cfg.Schemes {
+		scheme, err := newWebhookScheme(name, schemeConfig)
+		if err != nil {
+			return nil, err
+		}
+		wh.schemes[name] = scheme
+	}
+	return wh, nil
+}
+
+// webhooks verifies and makes webhook signatures.
+type webhooks struct {
+	schemes map[string]webhookScheme
+
+	seenLock sync.Mutex
+	seen     map[string]time.Time // signatures already verified, until they leave the replay window.
+}
+
+// Register adds the webhook routes to an app.
+func (wh *webhooks) Register(app *web.App) {
+	app.POST("/webhooks/verify/:scheme", wh.verify)
+	app.POST("/webhooks/sign", wh.sign)
+}
+
+// scheme returns a configured or built in scheme; `?secret=` supplies the secret if none is configured.
+func (wh *webhooks) scheme(r *web.Ctx, name string) (webhookScheme, bool) {
+	scheme, isConfigured := wh.schemes[name]
+	if !isConfigured {
+		if _, isType := webhookTypes[name]; !isType {
+			return webhookScheme{}, false
+		}
+		scheme, _ = newWebhookScheme(name, webhookSchemeConfig{})
+	}
+	if len(scheme.Secret) == 0 {
+		scheme.Secret = r.Request.URL.Query().Get("secret")
+	}
+	return scheme, true
+}
+
+// verify checks the signature sent with a webhook and reports why it didn't match.
+// Timestamped signatures are rejected outside the replay window or if already seen, unless `?allow_replay=true`.
+func (wh *webhooks) verify(r *web.Ctx) web.Result {
+	scheme, ok := wh.scheme(r, r.Param("scheme"))
+	if !ok {
+		return r.Negotiated().NotFound()
+	}
+	if len(scheme.Secret) == 0 {
+		return r.Negotiated().BadRequest(fmt.Sprintf("no secret is configured for `%s`; pass `?secret=`", scheme.Name))
+	}
+	body, err := r.PostBody()
+	if err != nil {
+		return r.Negotiated().InternalError(err)
+	}
+
+	report := webhookReport{Scheme: scheme.Name, Type: scheme.Type, Header: scheme.Header, BodyBytes: len(body)}
+	received, err := scheme.parse(r.Request.Header)
+	if err != nil {
+		report.Reason = err.Error()
+		return r.Negotiated().ResultWithStatus(http.StatusUnauthorized, report)
+	}
+	for _, candidate := range received.Candidates {
+		report.Received = append(report.Received, candidate.Raw)
+	}
+
+	payload := scheme.signedPayload(received.ID, received.Timestamp, body)
+	var matched []byte
+	for _, candidate := range received.Candidates {
+		expected := scheme.sign(candidate.Algorithm, payload)
+		if report.Algorithm == "" {
+			report.Algorithm = candidate.Algorithm
+		}
+		if util.Crypto.HMACEqual(expected, candidate.Value) {
+			matched = expected
+			break
+		}
+	}
+	if matched == nil {
+		report.Reason = "signature mismatch; check the secret and that the body is sent unmodified"
+		return r.Negotiated().ResultWithStatus(http.StatusUnauthorized, report)
+	}
+
+	if scheme.Timestamped() {
+		seconds, err := strconv.ParseInt(received.Timestamp, 10, 64)
+		if err != nil {
+			report.Reason = fmt.Sprintf("invalid timestamp `%s`; expected unix seconds", received.Timestamp)
+			return r.Negotiated().ResultWithStatus(http.StatusUnauthorized, report)
+		}
+		now := time.Now().UTC()
+		timestamp := time.Unix(seconds, 0).UTC()
+		age := now.Sub(timestamp)
+		report.Timestamp, report.Age, report.Tolerance = &timestamp, (age - age%time.Second).String(), scheme.Tolerance.String()
+		if age > scheme.Tolerance || age < -scheme.Tolerance {
+			report.Reason = fmt.Sprintf("timestamp is outside the %v replay window", scheme.Tolerance)
+			return r.Negotiated().ResultWithStatus(http.StatusUnauthorized, report)
+		}
+		if r.Request.URL.Query().Get("allow_replay") != "true" && wh.replayed(scheme, matched, timestamp.Add(scheme.Tolerance), now) {
+			report.Reason = "signature was already used; pass `?allow_replay=true` to allow it"
+			return r.Negotiated().ResultWithStatus(http.StatusUnauthorized, report)
+		}
+	}
+
+	report.Matched = true
+	return r.Negotiated().Result(report)
+}
+
+// replayed records a verified signature and returns if it was already seen; entries are dropped once they leave the replay window.
+func (wh *webhooks) replayed(scheme webhookScheme, signature []byte, expires, now time.Time) bool {
+	key := scheme.Name + ":" + hex.EncodeToString(signature)
+
+	wh.seenLock.Lock()
+	defer wh.seenLock.Unlock()
+	for seenKey, seenExpires := range wh.seen {
+		if now.After(seenExpires) {
+			delete(wh.seen, seenKey)
+		}
+	}
+	if _, seen := wh.seen[key]; seen {
+		return true
+	}
+	wh.seen[key] = expires
+	return false
+}
+
+// sign returns the signature headers for the request body under `?scheme=` (default generic).
+// `?timestamp=` (unix seconds) and `?id=` default to now and a random id.
+func (wh *webhooks) sign(r *web.Ctx) web.Result {
+	name := r.Request.URL.Query().Get("scheme")
+	if len(name) == 0 {
+		name = webhookTypeGeneric
+	}
+	scheme, ok := wh.scheme(r, name)
+	if !ok {
+		return r.Negotiated().BadRequest(fmt.Sprintf("unknown scheme `%s`; expected one of %s", name, strings.Join(wh.names(), ", ")))
+	}
+	if len(scheme.Secret) == 0 {
+		return r.Negotiated().BadRequest(fmt.Sprintf("no secret is configured for `%s`; pass `?secret=`", scheme.Name))
+	}
+	body, err := r.PostBody()
+	if err != nil {
+		return r.Negotiated().InternalError(err)
+	}
+
+	timestamp := r.Request.URL.Query().Get("timestamp")
+	if len(timestamp) == 0 {
+		timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+	} else if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+		return r.Negotiated().BadRequest(fmt.Sprintf("invalid timestamp `%s`; expected unix seconds", timestamp))
+	}
+	id := r.Request.URL.Query().Get("id")
+	if len(id) == 0 {
+		id = "msg_" + util.UUIDv4().ToShortString()
+	}
+	if !scheme.Timestamped() {
+		timestamp = ""
+	}
+	if len(scheme.IDHeader) == 0 {
+		id = ""
+	}
+
+	signature := scheme.sign("sha256", scheme.signedPayload(id, timestamp, body))
+	return r.Negotiated().Result(webhookSignature{
+		Scheme:    scheme.Name,
+		Type:      scheme.Type,
+		Algorithm: "sha256",
+		Signature: scheme.encode(signature),
+		Headers:   scheme.headers(id, timestamp, signature),
+	})
+}
+
+// names returns the configured and built in scheme names.
+func (wh *webhooks) names() []string {
+	var names []string
+	for name := range webhookTypes {
+		names = append(names, name)
+	}
+	for name := range wh.schemes {
+		if _, isType := webhookTypes[name]; !isType {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}